@@ -6,57 +6,145 @@ package backend
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
 )
 
+var (
+	ErrBackendOverloaded = errors.New("backend overloaded")
+	ErrBackendClosed     = errors.New("backend closed")
+	ErrBufferFailed      = errors.New("write buffer failed")
+)
+
 type CacheBuffer struct {
-	Buffer  *bytes.Buffer
-	Counter int
+	Buffer   *bytes.Buffer
+	Counter  int
+	Size     int
+	Acks     map[*WriteAck]int
+	Segments map[*walSegment]int
+	Deadline time.Time
+}
+
+func (cb *CacheBuffer) Append(point *LinePoint) (err error) {
+	line := point.Line
+	if cb.Buffer == nil {
+		cb.Buffer = &bytes.Buffer{}
+	}
+	cb.Counter++
+	cb.Size += len(line)
+	if point.Ack != nil {
+		if cb.Acks == nil {
+			cb.Acks = make(map[*WriteAck]int)
+		}
+		cb.Acks[point.Ack]++
+	}
+	if point.seg != nil {
+		if cb.Segments == nil {
+			cb.Segments = make(map[*walSegment]int)
+		}
+		cb.Segments[point.seg]++
+	}
+	n, err := cb.Buffer.Write(line)
+	if err != nil {
+		return
+	}
+	if n != len(line) {
+		return io.ErrShortWrite
+	}
+	if line[len(line)-1] != '\n' {
+		err = cb.Buffer.WriteByte('\n')
+	}
+	return
 }
 
 type Backend struct {
 	*HttpBackend
-	fb   *FileBackend
-	pool *ants.Pool
+	fb           *FileBackend
+	backlogCodec *Codec
+	wal          *WAL
+	pool         *ants.Pool
 
-	flushSize       int
-	flushTime       int
+	flushPolicies   atomic.Value
 	rewriteInterval int
 	rewriteTicker   *time.Ticker
 	chWrite         chan *LinePoint
 	chTimer         <-chan time.Time
-	buffers         map[string]map[string]*CacheBuffer
+	timerDeadline   time.Time
+	buffers         map[string]map[string]map[string]*CacheBuffer
 	wg              sync.WaitGroup
+	loops           sync.WaitGroup
+	closeLock       sync.RWMutex
+	closed          bool
+	chStop          chan struct{}
+	chReload        chan struct{}
+	stopped         chan struct{}
+
+	maxInflightPoints int64
+	maxInflightBytes  int64
+	overflowAction    string
+	inflightPoints    int64
+	inflightBytes     int64
+	spillLock         sync.Mutex
+	spills            map[string]map[string]map[string]*CacheBuffer
 }
 
 func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (ib *Backend) {
 	ib = &Backend{
 		HttpBackend:     NewHttpBackend(cfg, pxcfg),
-		flushSize:       pxcfg.FlushSize,
-		flushTime:       pxcfg.FlushTime,
 		rewriteInterval: pxcfg.RewriteInterval,
 		rewriteTicker:   time.NewTicker(time.Duration(pxcfg.RewriteInterval) * time.Second),
 		chWrite:         make(chan *LinePoint, 16),
-		buffers:         make(map[string]map[string]*CacheBuffer),
+		chStop:          make(chan struct{}),
+		chReload:        make(chan struct{}, 1),
+		stopped:         make(chan struct{}),
+		buffers:         make(map[string]map[string]map[string]*CacheBuffer),
+
+		maxInflightPoints: int64(pxcfg.MaxInflightPoints),
+		maxInflightBytes:  int64(pxcfg.MaxInflightBytes),
+		overflowAction:    pxcfg.OverflowAction,
+		spills:            make(map[string]map[string]map[string]*CacheBuffer),
 	}
 
+	ib.flushPolicies.Store(NewFlushPolicies(pxcfg))
+
 	var err error
 	ib.fb, err = NewFileBackend(cfg.Name, pxcfg.DataDir)
 	if err != nil {
 		panic(err)
 	}
+	// the backlog compression has been checked by checkConfig
+	ib.backlogCodec, err = NewCodec(pxcfg.BacklogCodec, pxcfg.BacklogCodecLevel)
+	if err != nil {
+		panic(err)
+	}
 	ib.pool, err = ants.NewPool(pxcfg.ConnPoolSize)
 	if err != nil {
 		panic(err)
 	}
+	if pxcfg.WALEnabled {
+		ib.wal, err = NewWAL(cfg.Name, pxcfg.DataDir, pxcfg.MaxLineSize)
+		if err != nil {
+			panic(err)
+		}
+		// the points left in the wal by the last run are moved to the backlog
+		if err = ib.wal.Replay(ib.WriteBacklog); err != nil {
+			panic(err)
+		}
+	}
 
 	go ib.worker()
+	if ib.maxInflightPoints > 0 || ib.maxInflightBytes > 0 {
+		ib.loops.Add(1)
+		go ib.spillWorker()
+	}
 	return
 }
 
@@ -70,16 +158,24 @@ func (ib *Backend) worker() {
 		case p, ok := <-ib.chWrite:
 			if !ok {
 				// closed
+				ib.rewriteTicker.Stop()
 				ib.Flush()
 				ib.wg.Wait()
+				ib.loops.Wait()
+				ib.FlushSpill()
+				ib.pool.Release()
+				if ib.wal != nil {
+					ib.wal.Close()
+				}
 				ib.HttpBackend.Close()
 				ib.fb.Close()
+				close(ib.stopped)
 				return
 			}
 			ib.WriteBuffer(p)
 
 		case <-ib.chTimer:
-			ib.Flush()
+			ib.FlushDue()
 
 		case <-ib.rewriteTicker.C:
 			ib.RewriteIdle()
@@ -88,106 +184,345 @@ func (ib *Backend) worker() {
 }
 
 func (ib *Backend) WritePoint(point *LinePoint) (err error) {
+	if ib.IsRejecting() {
+		return ErrBackendOverloaded
+	}
+	return ib.writePoint(point)
+}
+
+// writePoint buffers the point admitted by IsRejecting, or spills it when overloaded
+func (ib *Backend) writePoint(point *LinePoint) (err error) {
+	ib.closeLock.RLock()
+	defer ib.closeLock.RUnlock()
+	if ib.closed {
+		return ErrBackendClosed
+	}
+	overloaded := ib.IsOverloaded()
+	if ib.wal != nil {
+		seg, err := ib.wal.Append(point)
+		if err != nil {
+			return err
+		}
+		// the point may be shared by the backends of all circles, while the segment belongs to this backend
+		walPoint := *point
+		walPoint.seg = seg
+		point = &walPoint
+	}
+	if overloaded {
+		return ib.SpillPoint(point)
+	}
+	atomic.AddInt64(&ib.inflightPoints, 1)
+	atomic.AddInt64(&ib.inflightBytes, int64(len(point.Line)))
 	ib.chWrite <- point
 	return
 }
 
-func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
-	db, rp, line := point.Db, point.Rp, point.Line
-	// it's thread-safe since ib.buffers is only used (read-write) in ib.worker() goroutine
-	if _, ok := ib.buffers[db]; !ok {
-		ib.buffers[db] = make(map[string]*CacheBuffer)
+func (ib *Backend) getFlushPolicies() *FlushPolicies {
+	return ib.flushPolicies.Load().(*FlushPolicies)
+}
+
+// Reload applies the credentials, write timeout and flush policies of the new config,
+// and the buffers take the new flush policies since their next points
+func (ib *Backend) Reload(cfg *BackendConfig, pxcfg *ProxyConfig) {
+	ib.SetAuth(cfg.Username, cfg.Password, cfg.AuthEncrypt)
+	ib.SetWriteTimeout(pxcfg.WriteTimeout)
+	ib.flushPolicies.Store(NewFlushPolicies(pxcfg))
+	// notify the spill worker to reset its interval
+	select {
+	case ib.chReload <- struct{}{}:
+	default:
 	}
-	if _, ok := ib.buffers[db][rp]; !ok {
-		ib.buffers[db][rp] = &CacheBuffer{Buffer: &bytes.Buffer{}}
+}
+
+// IsRejecting reports whether the backend is overloaded and rejects the new points
+func (ib *Backend) IsRejecting() bool {
+	return ib.overflowAction == "reject" && ib.IsOverloaded()
+}
+
+// IsOverloaded reports whether the points in the channel, buffers and flushing tasks exceed the budget
+func (ib *Backend) IsOverloaded() bool {
+	return (ib.maxInflightPoints > 0 && atomic.LoadInt64(&ib.inflightPoints) >= ib.maxInflightPoints) ||
+		(ib.maxInflightBytes > 0 && atomic.LoadInt64(&ib.inflightBytes) >= ib.maxInflightBytes)
+}
+
+// SyncWAL commits the wal to the disk if enabled
+func (ib *Backend) SyncWAL() {
+	if ib.wal != nil {
+		ib.wal.Sync()
 	}
-	cb := ib.buffers[db][rp]
-	cb.Counter++
-	if cb.Buffer == nil {
-		cb.Buffer = &bytes.Buffer{}
+}
+
+// releaseWAL releases the points of the wal segments once they are written, backlogged or dropped
+func (ib *Backend) releaseWAL(segs map[*walSegment]int) {
+	for seg, n := range segs {
+		ib.wal.Done(seg, n)
 	}
-	n, err := cb.Buffer.Write(line)
-	if err != nil {
-		log.Printf("buffer write error: %s", err)
-		return
+}
+
+func (ib *Backend) releaseInflight(points, size int) {
+	atomic.AddInt64(&ib.inflightPoints, -int64(points))
+	atomic.AddInt64(&ib.inflightBytes, -int64(size))
+}
+
+// getCacheBuffer returns the buffer of db, rp and precision, and creates it if not exists
+func getCacheBuffer(buffers map[string]map[string]map[string]*CacheBuffer, db, rp, precision string) *CacheBuffer {
+	if _, ok := buffers[db]; !ok {
+		buffers[db] = make(map[string]map[string]*CacheBuffer)
 	}
-	if n != len(line) {
-		err = io.ErrShortWrite
+	if _, ok := buffers[db][rp]; !ok {
+		buffers[db][rp] = make(map[string]*CacheBuffer)
+	}
+	if _, ok := buffers[db][rp][precision]; !ok {
+		buffers[db][rp][precision] = &CacheBuffer{Buffer: &bytes.Buffer{}}
+	}
+	return buffers[db][rp][precision]
+}
+
+func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
+	db, rp, precision := point.Db, point.Rp, point.Precision
+	// it's thread-safe since ib.buffers is only used (read-write) in ib.worker() goroutine
+	cb := getCacheBuffer(ib.buffers, db, rp, precision)
+	fp := ib.getFlushPolicies().Get(db, rp)
+	if cb.Counter == 0 {
+		cb.Deadline = time.Now().Add(fp.Time)
+	}
+	err = cb.Append(point)
+	if err != nil {
 		log.Printf("buffer write error: %s", err)
 		return
 	}
-	if line[len(line)-1] != '\n' {
-		err = cb.Buffer.WriteByte('\n')
-		if err != nil {
-			log.Printf("buffer write error: %s", err)
-			return
-		}
-	}
 
-	switch {
-	case cb.Counter >= ib.flushSize:
-		ib.FlushBuffer(db, rp)
-	case ib.chTimer == nil:
-		ib.chTimer = time.After(time.Duration(ib.flushTime) * time.Second)
+	if fp.Reached(cb) {
+		ib.FlushBuffer(db, rp, precision)
+	} else {
+		ib.setTimer(cb.Deadline)
 	}
 	return
 }
 
-func (ib *Backend) FlushBuffer(db, rp string) {
-	cb := ib.buffers[db][rp]
+// setTimer makes the timer fire at the deadline if it's earlier than the current one
+func (ib *Backend) setTimer(deadline time.Time) {
+	if ib.chTimer == nil || deadline.Before(ib.timerDeadline) {
+		ib.chTimer = time.After(time.Until(deadline))
+		ib.timerDeadline = deadline
+	}
+}
+
+func (ib *Backend) FlushBuffer(db, rp, precision string) {
+	cb := ib.buffers[db][rp][precision]
 	if cb.Buffer == nil {
 		return
 	}
 	p := cb.Buffer.Bytes()
+	acks, segs, counter, size := cb.Acks, cb.Segments, cb.Counter, cb.Size
 	cb.Buffer = nil
 	cb.Counter = 0
+	cb.Size = 0
+	cb.Acks = nil
+	cb.Segments = nil
 	if len(p) == 0 {
+		ib.releaseInflight(counter, size)
+		ib.releaseWAL(segs)
 		return
 	}
 
 	ib.wg.Add(1)
-	ib.pool.Submit(func() {
+	err := ib.pool.Submit(func() {
 		defer ib.wg.Done()
-		var buf bytes.Buffer
-		err := Compress(&buf, p)
-		if err != nil {
-			log.Print("compress buffer error: ", err)
-			return
+		state := ib.WriteBatch(db, rp, precision, p)
+		ib.releaseInflight(counter, size)
+		ib.releaseWAL(segs)
+		for ack, n := range acks {
+			ack.Done(n, state)
 		}
+	})
+	if err != nil {
+		ib.wg.Done()
+		log.Printf("submit flush task error: %s %s %s %s, length: %d, error: %s", ib.Url, db, rp, precision, len(p), err)
+		ib.releaseInflight(counter, size)
+		// the batch goes to the backlog to be rewritten, so that the wal is released in the same way as flushed
+		state := FlushBacklogged
+		if err = ib.WriteBacklog(db, rp, precision, p); err != nil {
+			state = FlushDropped
+		}
+		ib.releaseWAL(segs)
+		for ack, n := range acks {
+			ack.Done(n, state)
+		}
+	}
+}
 
-		p = buf.Bytes()
+func (ib *Backend) WriteBatch(db, rp, precision string, p []byte) FlushState {
+	if ib.IsActive() {
+		err := ib.Write(db, rp, precision, p)
+		switch err {
+		case nil:
+			return FlushWritten
+		case ErrBadRequest:
+			log.Printf("bad request, drop all data")
+			return FlushDropped
+		case ErrNotFound:
+			log.Printf("bad backend, drop all data")
+			return FlushDropped
+		default:
+			log.Printf("write http error: %s %s %s %s, length: %d", ib.Url, db, rp, precision, len(p))
+		}
+	}
 
-		if ib.IsActive() {
-			err = ib.WriteCompressed(db, rp, p)
-			switch err {
-			case nil:
-				return
-			case ErrBadRequest:
-				log.Printf("bad request, drop all data")
-				return
-			case ErrNotFound:
-				log.Printf("bad backend, drop all data")
-				return
-			default:
-				log.Printf("write http error: %s %s %s, length: %d", ib.Url, db, rp, len(p))
+	err := ib.WriteBacklog(db, rp, precision, p)
+	if err != nil {
+		return FlushDropped
+	}
+	return FlushBacklogged
+}
+
+// WriteBacklog encodes the data by the backlog compression, and writes a record of db, rp, precision,
+// compression and data separated by spaces to the file backend
+func (ib *Backend) WriteBacklog(db, rp, precision string, p []byte) (err error) {
+	p, err = ib.backlogCodec.Encode(p)
+	if err != nil {
+		log.Printf("compress %s backlog error: %s", ib.backlogCodec.Name, err)
+		return
+	}
+	b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), []byte(url.QueryEscape(rp)), []byte(precision), []byte(ib.backlogCodec.Name), p}, []byte{' '})
+	err = ib.fb.Write(b)
+	if err != nil {
+		log.Printf("write db and data to file error with db: %s, rp: %s, precision: %s, length: %d error: %s", db, rp, precision, len(p), err)
+	}
+	return
+}
+
+// parseBacklog parses a record of the file backend, the record written by the former versions
+// has no precision or compression and its data is always gzip, whose magic number never matches them
+func parseBacklog(b []byte) (db, rp, precision, codec string, p []byte, err error) {
+	parts := bytes.SplitN(b, []byte{' '}, 3)
+	if len(parts) < 3 {
+		err = fmt.Errorf("invalid data with length: %d", len(parts))
+		return
+	}
+	db, err = url.QueryUnescape(string(parts[0]))
+	if err != nil {
+		err = fmt.Errorf("db unescape error: %s", err)
+		return
+	}
+	rp, err = url.QueryUnescape(string(parts[1]))
+	if err != nil {
+		err = fmt.Errorf("rp unescape error: %s", err)
+		return
+	}
+	precision, codec, p = "ns", CodecGzip, parts[2]
+	if i := bytes.IndexByte(p, ' '); i > 0 {
+		switch string(p[:i]) {
+		case "ns", "u", "ms", "s", "m", "h":
+			precision, p = string(p[:i]), p[i+1:]
+		}
+	}
+	if i := bytes.IndexByte(p, ' '); i > 0 {
+		switch string(p[:i]) {
+		case CodecNone, CodecGzip, CodecZstd, CodecSnappy:
+			codec, p = string(p[:i]), p[i+1:]
+		}
+	}
+	return
+}
+
+// SpillPoint bypasses the overloaded buffers and writes the point to the file backend in batches
+func (ib *Backend) SpillPoint(point *LinePoint) (err error) {
+	db, rp, precision := point.Db, point.Rp, point.Precision
+	ib.spillLock.Lock()
+	defer ib.spillLock.Unlock()
+	cb := getCacheBuffer(ib.spills, db, rp, precision)
+	err = cb.Append(point)
+	if err != nil {
+		return
+	}
+	if ib.getFlushPolicies().Get(db, rp).Reached(cb) {
+		ib.flushSpill(db, rp, precision, cb)
+	}
+	return
+}
+
+func (ib *Backend) flushSpill(db, rp, precision string, cb *CacheBuffer) {
+	if cb.Buffer == nil || cb.Buffer.Len() == 0 {
+		return
+	}
+	p, acks, segs := cb.Buffer.Bytes(), cb.Acks, cb.Segments
+	cb.Buffer = nil
+	cb.Counter = 0
+	cb.Size = 0
+	cb.Acks = nil
+	cb.Segments = nil
+
+	state := FlushBacklogged
+	if err := ib.WriteBacklog(db, rp, precision, p); err != nil {
+		state = FlushDropped
+	}
+	ib.releaseWAL(segs)
+	for ack, n := range acks {
+		ack.Done(n, state)
+	}
+}
+
+func (ib *Backend) FlushSpill() {
+	ib.spillLock.Lock()
+	defer ib.spillLock.Unlock()
+	for db := range ib.spills {
+		for rp := range ib.spills[db] {
+			for precision, cb := range ib.spills[db][rp] {
+				ib.flushSpill(db, rp, precision, cb)
 			}
 		}
+	}
+}
 
-		b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), []byte(url.QueryEscape(rp)), p}, []byte{' '})
-		err = ib.fb.Write(b)
-		if err != nil {
-			log.Printf("write db and data to file error with db: %s, rp: %s, length: %d error: %s", db, rp, len(p), err)
+func (ib *Backend) spillWorker() {
+	defer ib.loops.Done()
+	interval := ib.getFlushPolicies().Default().Time
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ib.FlushSpill()
+		case <-ib.chReload:
+			if d := ib.getFlushPolicies().Default().Time; d != interval {
+				interval = d
+				ticker.Reset(interval)
+			}
+		case <-ib.chStop:
 			return
 		}
-	})
+	}
+}
+
+// FlushDue flushes the buffers reaching their flush time, and sets the timer by the earliest deadline of the others
+func (ib *Backend) FlushDue() {
+	ib.chTimer = nil
+	now := time.Now()
+	for db := range ib.buffers {
+		for rp := range ib.buffers[db] {
+			for precision, cb := range ib.buffers[db][rp] {
+				if cb.Counter == 0 {
+					continue
+				}
+				if cb.Deadline.After(now) {
+					ib.setTimer(cb.Deadline)
+				} else {
+					ib.FlushBuffer(db, rp, precision)
+				}
+			}
+		}
+	}
 }
 
 func (ib *Backend) Flush() {
 	ib.chTimer = nil
 	for db := range ib.buffers {
 		for rp := range ib.buffers[db] {
-			if ib.buffers[db][rp].Counter > 0 {
-				ib.FlushBuffer(db, rp)
+			for precision, cb := range ib.buffers[db][rp] {
+				if cb.Counter > 0 {
+					ib.FlushBuffer(db, rp, precision)
+				}
 			}
 		}
 	}
@@ -196,23 +531,30 @@ func (ib *Backend) Flush() {
 func (ib *Backend) RewriteIdle() {
 	if !ib.IsRewriting() && ib.fb.IsData() {
 		ib.SetRewriting(true)
+		ib.loops.Add(1)
 		go ib.RewriteLoop()
 	}
 }
 
+// RewriteLoop rewrites the backlog until it is empty or the backend is closing,
+// it only stops between two records so that the meta always matches the records written
 func (ib *Backend) RewriteLoop() {
+	defer ib.loops.Done()
+	defer ib.SetRewriting(false)
 	for ib.fb.IsData() {
-		if !ib.IsActive() {
-			time.Sleep(time.Duration(ib.rewriteInterval) * time.Second)
-			continue
+		select {
+		case <-ib.chStop:
+			return
+		default:
 		}
-		err := ib.Rewrite()
-		if err != nil {
-			time.Sleep(time.Duration(ib.rewriteInterval) * time.Second)
-			continue
+		if !ib.IsActive() || ib.Rewrite() != nil {
+			select {
+			case <-time.After(time.Duration(ib.rewriteInterval) * time.Second):
+			case <-ib.chStop:
+				return
+			}
 		}
 	}
-	ib.SetRewriting(false)
 }
 
 func (ib *Backend) Rewrite() (err error) {
@@ -225,22 +567,23 @@ func (ib *Backend) Rewrite() (err error) {
 		return
 	}
 
-	p := bytes.SplitN(b, []byte{' '}, 3)
-	if len(p) < 3 {
-		log.Print("rewrite read invalid data with length: ", len(p))
-		return
-	}
-	db, err := url.QueryUnescape(string(p[0]))
+	db, rp, precision, codec, p, err := parseBacklog(b)
 	if err != nil {
-		log.Print("rewrite db unescape error: ", err)
+		log.Print("rewrite read ", err)
 		return
 	}
-	rp, err := url.QueryUnescape(string(p[1]))
-	if err != nil {
-		log.Print("rewrite rp unescape error: ", err)
-		return
+	if codec == ib.codec.Name {
+		err = ib.WriteEncoded(db, rp, precision, p)
+	} else {
+		// the backlog is recompressed when the compression of the backend differs
+		var raw []byte
+		raw, err = DecodeCodec(codec, p)
+		if err != nil {
+			log.Printf("rewrite decode %s error: %s, drop all data", codec, err)
+			return ib.fb.UpdateMeta()
+		}
+		err = ib.Write(db, rp, precision, raw)
 	}
-	err = ib.WriteCompressed(db, rp, p[2])
 
 	switch err {
 	case nil:
@@ -251,7 +594,7 @@ func (ib *Backend) Rewrite() (err error) {
 		log.Printf("bad backend, drop all data")
 		err = nil
 	default:
-		log.Printf("rewrite http error: %s %s %s, length: %d", ib.Url, db, rp, len(p[1]))
+		log.Printf("rewrite http error: %s %s %s %s, length: %d", ib.Url, db, rp, precision, len(p))
 
 		err = ib.fb.RollbackMeta()
 		if err != nil {
@@ -267,28 +610,42 @@ func (ib *Backend) Rewrite() (err error) {
 	return
 }
 
-func (ib *Backend) Close() {
-	ib.pool.Release()
-	close(ib.chWrite)
+// Close rejects the new points, stops the rewrite loop, and flushes the buffers to the backend or the backlog,
+// the returned channel is closed once all are drained
+func (ib *Backend) Close() <-chan struct{} {
+	ib.closeLock.Lock()
+	defer ib.closeLock.Unlock()
+	if !ib.closed {
+		ib.closed = true
+		close(ib.chStop)
+		close(ib.chWrite)
+	}
+	return ib.stopped
 }
 
 func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 	health := struct {
-		Name      string      `json:"name"`
-		Url       string      `json:"url"` // nolint:golint
-		Active    bool        `json:"active"`
-		Backlog   bool        `json:"backlog"`
-		Rewriting bool        `json:"rewriting"`
-		WriteOnly bool        `json:"write_only"`
-		Healthy   bool        `json:"healthy,omitempty"`
-		Stats     interface{} `json:"stats,omitempty"`
+		Name           string      `json:"name"`
+		Url            string      `json:"url"` // nolint:golint
+		Active         bool        `json:"active"`
+		Backlog        bool        `json:"backlog"`
+		Rewriting      bool        `json:"rewriting"`
+		WriteOnly      bool        `json:"write_only"`
+		Overloaded     bool        `json:"overloaded"`
+		InflightPoints int64       `json:"inflight_points"`
+		InflightBytes  int64       `json:"inflight_bytes"`
+		Healthy        bool        `json:"healthy,omitempty"`
+		Stats          interface{} `json:"stats,omitempty"`
 	}{
-		Name:      ib.Name,
-		Url:       ib.Url,
-		Active:    ib.IsActive(),
-		Backlog:   ib.fb.IsData(),
-		Rewriting: ib.IsRewriting(),
-		WriteOnly: ib.IsWriteOnly(),
+		Name:           ib.Name,
+		Url:            ib.Url,
+		Active:         ib.IsActive(),
+		Backlog:        ib.fb.IsData(),
+		Rewriting:      ib.IsRewriting(),
+		WriteOnly:      ib.IsWriteOnly(),
+		Overloaded:     ib.IsOverloaded(),
+		InflightPoints: atomic.LoadInt64(&ib.inflightPoints),
+		InflightBytes:  atomic.LoadInt64(&ib.inflightBytes),
 	}
 	if !withStats {
 		return health
@@ -300,9 +657,14 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 		wg.Add(1)
 		go func(db string) {
 			defer wg.Done()
-			inplace, incorrect := 0, 0
+			inplace, incorrect, sharded := 0, 0, 0
 			measurements := ib.GetMeasurements(db)
 			for _, meas := range measurements {
+				if ic.ShardRules.IsSharded(db, meas) {
+					// the series of sharded measurement are spread over all backends
+					sharded++
+					continue
+				}
 				key := GetKey(db, meas)
 				nb := ic.GetBackend(key)
 				if nb.Url == ib.Url {
@@ -315,6 +677,7 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 				"measurements": len(measurements),
 				"inplace":      inplace,
 				"incorrect":    incorrect,
+				"sharded":      sharded,
 			})
 		}(db)
 	}
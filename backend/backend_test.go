@@ -0,0 +1,116 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseBacklog(t *testing.T) {
+	tests := []struct {
+		name      string
+		record    string
+		db        string
+		rp        string
+		precision string
+		codec     string
+		data      string
+	}{
+		{
+			name:      "codec",
+			record:    "db%20x autogen s none cpu value=1 1596819659",
+			db:        "db x",
+			rp:        "autogen",
+			precision: "s",
+			codec:     "none",
+			data:      "cpu value=1 1596819659",
+		},
+		{
+			name:      "precision",
+			record:    "db%20x autogen s \x1f\x8b data",
+			db:        "db x",
+			rp:        "autogen",
+			precision: "s",
+			codec:     "gzip",
+			data:      "\x1f\x8b data",
+		},
+		{
+			name:      "former",
+			record:    "db  \x1f\x8b data",
+			db:        "db",
+			rp:        "",
+			precision: "ns",
+			codec:     "gzip",
+			data:      "\x1f\x8b data",
+		},
+	}
+	for _, tt := range tests {
+		db, rp, precision, codec, p, err := parseBacklog([]byte(tt.record))
+		if err != nil || db != tt.db || rp != tt.rp || precision != tt.precision || codec != tt.codec || string(p) != tt.data {
+			t.Errorf("%v: got %q %q %q %q %q %v", tt.name, db, rp, precision, codec, p, err)
+		}
+	}
+	if _, _, _, _, _, err := parseBacklog([]byte("db")); err == nil {
+		t.Error("expect error")
+	}
+}
+
+func TestBackendClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	written := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			p, _ := ioutil.ReadAll(req.Body)
+			written <- string(p)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	pxcfg := &ProxyConfig{DataDir: dir, FlushTime: 60}
+	pxcfg.setDefault()
+	ib := NewBackend(&BackendConfig{Name: "influxdb", Url: ts.URL, Compression: CodecNone}, pxcfg)
+	if err = ib.WritePoint(&LinePoint{Db: "db1", Precision: "s", Line: []byte("cpu value=1 1596819659")}); err != nil {
+		t.Fatalf("write point error: %s", err)
+	}
+
+	// the buffer is flushed on close long before the flush time
+	select {
+	case <-ib.Close():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the backend drained")
+	}
+	select {
+	case p := <-written:
+		if p != "cpu value=1 1596819659\n" {
+			t.Errorf("unexpected write %q", p)
+		}
+	default:
+		t.Error("expect the buffer flushed")
+	}
+	if err = ib.WritePoint(&LinePoint{Db: "db1", Precision: "s", Line: []byte("cpu value=2 1596819660")}); err != ErrBackendClosed {
+		t.Errorf("expect ErrBackendClosed, got %v", err)
+	}
+
+	// the point not buffered fails the write instead of being acknowledged
+	pxcfg.Circles = []*CircleConfig{{Name: "circle", Backends: []*BackendConfig{{Name: "influxdb", Url: ts.URL}}}}
+	ip := NewProxy(pxcfg)
+	ip.Close(context.Background())
+	if err = ip.Write([]byte("cpu value=3 1596819661"), "db1", "", "s"); !errors.Is(err, ErrBufferFailed) {
+		t.Errorf("expect ErrBufferFailed, got %v", err)
+	}
+}
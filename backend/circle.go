@@ -15,6 +15,7 @@ type Circle struct {
 	CircleId     int // nolint:golint
 	Name         string
 	Backends     []*Backend
+	ShardRules   *ShardRules
 	router       *consistent.Consistent
 	routerCaches sync.Map
 	mapToBackend map[string]*Backend
@@ -25,6 +26,7 @@ func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int) (ic *Circle)
 		CircleId:     circleId,
 		Name:         cfg.Name,
 		Backends:     make([]*Backend, len(cfg.Backends)),
+		ShardRules:   NewShardRules(pxcfg.ShardRules),
 		router:       consistent.New(),
 		mapToBackend: make(map[string]*Backend),
 	}
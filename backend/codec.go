@@ -0,0 +1,137 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecNone   = "none"
+	CodecGzip   = "gzip"
+	CodecZstd   = "zstd"
+	CodecSnappy = "snappy"
+)
+
+var (
+	ErrInvalidCodec      = errors.New("invalid compression, require none, gzip, zstd or snappy")
+	ErrInvalidCodecLevel = errors.New("invalid compression level, require 1-9 for gzip or 1-22 for zstd")
+	ErrDecodedTooLarge   = errors.New("decoded size too large")
+)
+
+var (
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderOnce sync.Once
+)
+
+// Codec encodes the batches written to the backends or to the backlog
+type Codec struct {
+	Name  string
+	level int
+	zenc  *zstd.Encoder
+}
+
+// NewCodec creates the codec, empty name means gzip, and level 0 means the default level of gzip or zstd
+func NewCodec(name string, level int) (c *Codec, err error) {
+	c = &Codec{Name: name, level: level}
+	switch name {
+	case "", CodecGzip:
+		c.Name = CodecGzip
+		if level == 0 {
+			c.level = gzip.DefaultCompression
+		} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return nil, ErrInvalidCodecLevel
+		}
+	case CodecZstd:
+		zlevel := zstd.SpeedDefault
+		if level < 0 || level > 22 {
+			return nil, ErrInvalidCodecLevel
+		} else if level > 0 {
+			zlevel = zstd.EncoderLevelFromZstd(level)
+		}
+		c.zenc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zlevel))
+		if err != nil {
+			return nil, err
+		}
+	case CodecNone, CodecSnappy:
+	default:
+		return nil, ErrInvalidCodec
+	}
+	return
+}
+
+// ContentEncoding returns the Content-Encoding header of the encoded body, none has no header
+func (c *Codec) ContentEncoding() string {
+	if c.Name == CodecNone {
+		return ""
+	}
+	return c.Name
+}
+
+func (c *Codec) Encode(p []byte) ([]byte, error) {
+	switch c.Name {
+	case CodecGzip:
+		var buf bytes.Buffer
+		zip, err := gzip.NewWriterLevel(&buf, c.level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = zip.Write(p); err != nil {
+			return nil, err
+		}
+		if err = zip.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		return c.zenc.EncodeAll(p, nil), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, p), nil
+	}
+	return p, nil
+}
+
+// DecodeSnappy decodes the snappy block whose decoded size is checked against max before allocation, 0 means unlimited
+func DecodeSnappy(p []byte, max int) ([]byte, error) {
+	n, err := snappy.DecodedLen(p)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && n > max {
+		return nil, ErrDecodedTooLarge
+	}
+	return snappy.Decode(nil, p)
+}
+
+// DecodeCodec decodes the data encoded by the codec of the name
+func DecodeCodec(name string, p []byte) ([]byte, error) {
+	switch name {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	case CodecZstd:
+		zstdDecoderOnce.Do(func() {
+			zstdDecoder, _ = zstd.NewReader(nil)
+		})
+		return zstdDecoder.DecodeAll(p, nil)
+	case CodecSnappy:
+		// a snappy copy of 3 bytes expands to at most 64 bytes, a larger decoded size means the block is corrupt
+		return DecodeSnappy(p, len(p)*64/3)
+	}
+	return nil, ErrInvalidCodec
+}
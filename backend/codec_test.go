@@ -0,0 +1,70 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestCodec(t *testing.T) {
+	p := bytes.Repeat([]byte("cpu,host=server01,region=uswest value=0.64 1596819659\n"), 100)
+	tests := []struct {
+		name     string
+		level    int
+		encoding string
+	}{
+		{"none", 0, ""},
+		{"", 0, "gzip"},
+		{"gzip", 1, "gzip"},
+		{"zstd", 0, "zstd"},
+		{"zstd", 19, "zstd"},
+		{"snappy", 0, "snappy"},
+	}
+	for _, tt := range tests {
+		c, err := NewCodec(tt.name, tt.level)
+		if err != nil {
+			t.Fatalf("%s: new codec error: %s", tt.name, err)
+		}
+		if c.ContentEncoding() != tt.encoding {
+			t.Errorf("%s: got encoding %q, want %q", tt.name, c.ContentEncoding(), tt.encoding)
+		}
+		b, err := c.Encode(p)
+		if err != nil {
+			t.Fatalf("%s: encode error: %s", tt.name, err)
+		}
+		if tt.name != "none" && len(b) >= len(p) {
+			t.Errorf("%s: expect compressed, got %d bytes", tt.name, len(b))
+		}
+		if d, err := DecodeCodec(c.Name, b); err != nil || !bytes.Equal(d, p) {
+			t.Errorf("%s: decode mismatch, error: %v", tt.name, err)
+		}
+	}
+
+	if _, err := NewCodec("lz4", 0); err != ErrInvalidCodec {
+		t.Errorf("expect ErrInvalidCodec, got %v", err)
+	}
+	if _, err := NewCodec("gzip", 10); err != ErrInvalidCodecLevel {
+		t.Errorf("expect ErrInvalidCodecLevel, got %v", err)
+	}
+
+	b := snappy.Encode(nil, p)
+	if _, err := DecodeSnappy(b, len(p)-1); err != ErrDecodedTooLarge {
+		t.Errorf("expect ErrDecodedTooLarge, got %v", err)
+	}
+	if d, err := DecodeSnappy(b, len(p)); err != nil || !bytes.Equal(d, p) {
+		t.Errorf("snappy: decode mismatch, error: %v", err)
+	}
+	// a corrupt length prefix claiming 1 GiB
+	hdr := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(hdr, uint64(len(p)))
+	corrupt := append(hdr[:binary.PutUvarint(hdr, 1<<30)], b[n:]...)
+	if _, err := DecodeCodec(CodecSnappy, corrupt); err != ErrDecodedTooLarge {
+		t.Errorf("expect ErrDecodedTooLarge, got %v", err)
+	}
+}
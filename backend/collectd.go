@@ -0,0 +1,369 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+// the part types of the collectd binary protocol
+const (
+	collectdHost           = 0x0000
+	collectdTime           = 0x0001
+	collectdPlugin         = 0x0002
+	collectdPluginInstance = 0x0003
+	collectdType           = 0x0004
+	collectdTypeInstance   = 0x0005
+	collectdValues         = 0x0006
+	collectdTimeHR         = 0x0008
+	collectdSignature      = 0x0200
+	collectdEncryption     = 0x0210
+)
+
+// the data source types of the values
+const (
+	collectdCounter  = 0
+	collectdGauge    = 1
+	collectdDerive   = 2
+	collectdAbsolute = 3
+)
+
+const (
+	CollectdSecurityNone    = "none"
+	CollectdSecuritySign    = "sign"
+	CollectdSecurityEncrypt = "encrypt"
+)
+
+var (
+	ErrCollectdInvalidPart    = errors.New("invalid collectd part")
+	ErrCollectdInvalidValues  = errors.New("invalid collectd values")
+	ErrCollectdUnknownUser    = errors.New("unknown collectd user")
+	ErrCollectdInvalidSign    = errors.New("invalid collectd signature")
+	ErrCollectdInvalidEncrypt = errors.New("invalid collectd encrypted data")
+	ErrCollectdSecurityLevel  = errors.New("collectd packet doesn't meet the security level")
+)
+
+// CollectdTypes maps the type name to the data source names defined in types.db
+type CollectdTypes map[string][]string
+
+// LoadCollectdTypes loads the types.db files, a path could be a file or a directory of files
+func LoadCollectdTypes(paths []string) (CollectdTypes, error) {
+	types := make(CollectdTypes)
+	for _, path := range paths {
+		files := []string{path}
+		if fi, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if fi.IsDir() {
+			if files, err = filepath.Glob(filepath.Join(path, "*")); err != nil {
+				return nil, err
+			}
+		}
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			err = types.Parse(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("invalid collectd typesdb %s: %s", file, err)
+			}
+		}
+	}
+	return types, nil
+}
+
+// Parse parses the lines like: if_octets  rx:DERIVE:0:U, tx:DERIVE:0:U
+func (types CollectdTypes) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid line %q", line)
+		}
+		var names []string
+		for _, ds := range strings.Split(strings.Join(fields[1:], ""), ",") {
+			parts := strings.Split(ds, ":")
+			if len(parts) != 4 || parts[0] == "" {
+				return fmt.Errorf("invalid data source %q", ds)
+			}
+			names = append(names, parts[0])
+		}
+		types[fields[0]] = names
+	}
+	return scanner.Err()
+}
+
+// LoadCollectdAuthFile loads the auth file of collectd, with the lines like: user: password
+func LoadCollectdAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid collectd auth_file line %q", line)
+		}
+		users[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return users, scanner.Err()
+}
+
+// CollectdParser converts the packets of the collectd binary protocol into the line protocol
+type CollectdParser struct {
+	types CollectdTypes
+	users map[string]string
+	level int
+}
+
+func NewCollectdParser(types CollectdTypes, users map[string]string, securityLevel string) (*CollectdParser, error) {
+	cp := &CollectdParser{types: types, users: users}
+	switch securityLevel {
+	case "", CollectdSecurityNone:
+	case CollectdSecuritySign:
+		cp.level = 1
+	case CollectdSecurityEncrypt:
+		cp.level = 2
+	default:
+		return nil, ErrInvalidCollectdSecure
+	}
+	return cp, nil
+}
+
+// collectdState is the state shared by the following parts until it's changed
+type collectdState struct {
+	host, plugin, pluginInstance, typ, typeInstance string
+	time                                            int64
+	lines                                           [][]byte
+}
+
+// Parse converts the values of a packet into the lines with ns precision, the measurement is plugin_type,
+// the tags are host, instance and type_instance, and the fields are the data source names in types.db
+func (cp *CollectdParser) Parse(buf []byte) ([][]byte, error) {
+	st := &collectdState{}
+	err := cp.parse(buf, st, 0)
+	return st.lines, err
+}
+
+// parse parses the parts of buf, secured is 1 if buf is signed, and 2 if buf is encrypted
+func (cp *CollectdParser) parse(buf []byte, st *collectdState, secured int) error {
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return ErrCollectdInvalidPart
+		}
+		typ := binary.BigEndian.Uint16(buf[0:2])
+		length := int(binary.BigEndian.Uint16(buf[2:4]))
+		if length < 4 || length > len(buf) {
+			return ErrCollectdInvalidPart
+		}
+		part := buf[4:length]
+		buf = buf[length:]
+
+		switch typ {
+		case collectdHost:
+			st.host = collectdString(part)
+		case collectdPlugin:
+			st.plugin = collectdString(part)
+		case collectdPluginInstance:
+			st.pluginInstance = collectdString(part)
+		case collectdType:
+			st.typ = collectdString(part)
+		case collectdTypeInstance:
+			st.typeInstance = collectdString(part)
+		case collectdTime, collectdTimeHR:
+			if len(part) != 8 {
+				return ErrCollectdInvalidPart
+			}
+			v := binary.BigEndian.Uint64(part)
+			if typ == collectdTime {
+				st.time = int64(v) * int64(time.Second)
+			} else {
+				// the high resolution time is in 2^-30 seconds
+				st.time = int64(v>>30)*int64(time.Second) + int64((v&(1<<30-1))*uint64(time.Second)>>30)
+			}
+		case collectdValues:
+			if secured < cp.level {
+				return ErrCollectdSecurityLevel
+			}
+			line, err := cp.line(st, part)
+			if err != nil {
+				return err
+			}
+			if line != nil {
+				st.lines = append(st.lines, line)
+			}
+		case collectdSignature:
+			if err := cp.verify(part, buf); err != nil {
+				return err
+			}
+			if secured < 1 {
+				secured = 1
+			}
+		case collectdEncryption:
+			plain, err := cp.decrypt(part)
+			if err != nil {
+				return err
+			}
+			if err = cp.parse(plain, st, 2); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func collectdString(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// verify checks the hmac-sha256 signature of the username and the following parts
+func (cp *CollectdParser) verify(part, rest []byte) error {
+	if len(part) < sha256.Size {
+		return ErrCollectdInvalidPart
+	}
+	user := string(part[sha256.Size:])
+	password, ok := cp.users[user]
+	if !ok {
+		if cp.level == 0 {
+			// the signature is ignored without the security
+			return nil
+		}
+		return ErrCollectdUnknownUser
+	}
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(part[sha256.Size:])
+	mac.Write(rest)
+	if !hmac.Equal(mac.Sum(nil), part[:sha256.Size]) {
+		return ErrCollectdInvalidSign
+	}
+	return nil
+}
+
+// decrypt decrypts the parts by aes-256-ofb with the key sha256(password), and checks the sha1 checksum
+func (cp *CollectdParser) decrypt(part []byte) ([]byte, error) {
+	if len(part) < 2 {
+		return nil, ErrCollectdInvalidPart
+	}
+	ulen := int(binary.BigEndian.Uint16(part[0:2]))
+	if len(part) < 2+ulen+aes.BlockSize+sha1.Size {
+		return nil, ErrCollectdInvalidPart
+	}
+	password, ok := cp.users[string(part[2:2+ulen])]
+	if !ok {
+		return nil, ErrCollectdUnknownUser
+	}
+	iv := part[2+ulen : 2+ulen+aes.BlockSize]
+	data := make([]byte, len(part)-2-ulen-aes.BlockSize)
+	key := sha256.Sum256([]byte(password))
+	block, _ := aes.NewCipher(key[:])
+	cipher.NewOFB(block, iv).XORKeyStream(data, part[2+ulen+aes.BlockSize:])
+	checksum := sha1.Sum(data[sha1.Size:])
+	if !bytes.Equal(checksum[:], data[:sha1.Size]) {
+		return nil, ErrCollectdInvalidEncrypt
+	}
+	return data[sha1.Size:], nil
+}
+
+func (cp *CollectdParser) line(st *collectdState, part []byte) ([]byte, error) {
+	if len(part) < 2 {
+		return nil, ErrCollectdInvalidValues
+	}
+	n := int(binary.BigEndian.Uint16(part[0:2]))
+	if len(part) != 2+n*9 {
+		return nil, ErrCollectdInvalidValues
+	}
+	names, ok := cp.types[st.typ]
+	if !ok && n == 1 {
+		names = []string{"value"}
+	}
+	if len(names) != n {
+		return nil, fmt.Errorf("collectd type %q has %d values, but %d data sources in typesdb", st.typ, n, len(names))
+	}
+
+	var b bytes.Buffer
+	b.WriteString(util.EscapeMeasurement(st.plugin + "_" + st.typ))
+	tags := map[string]string{"host": st.host, "instance": st.pluginInstance, "type_instance": st.typeInstance}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if tags[k] != "" {
+			b.WriteByte(',')
+			b.WriteString(k)
+			b.WriteByte('=')
+			b.WriteString(util.EscapeTag(tags[k]))
+		}
+	}
+	written := 0
+	for i := 0; i < n; i++ {
+		raw := part[2+n+i*8 : 2+n+i*8+8]
+		var value float64
+		switch part[2+i] {
+		case collectdGauge:
+			value = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		case collectdDerive:
+			value = float64(int64(binary.BigEndian.Uint64(raw)))
+		case collectdCounter, collectdAbsolute:
+			value = float64(binary.BigEndian.Uint64(raw))
+		default:
+			return nil, ErrCollectdInvalidValues
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		if written == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(util.EscapeTag(names[i]))
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+		written++
+	}
+	if written == 0 {
+		return nil, nil
+	}
+	ts := st.time
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts, 10))
+	return b.Bytes(), nil
+}
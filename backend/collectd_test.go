@@ -0,0 +1,143 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+func collectdPart(typ uint16, payload []byte) []byte {
+	b := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], typ)
+	binary.BigEndian.PutUint16(b[2:4], uint16(4+len(payload)))
+	return append(b, payload...)
+}
+
+func collectdStringPart(typ uint16, s string) []byte {
+	return collectdPart(typ, append([]byte(s), 0))
+}
+
+func collectdValuesPart(types []byte, values []uint64) []byte {
+	b := make([]byte, 2, 2+9*len(types))
+	binary.BigEndian.PutUint16(b, uint16(len(types)))
+	b = append(b, types...)
+	for i, v := range values {
+		raw := make([]byte, 8)
+		if types[i] == collectdGauge {
+			binary.LittleEndian.PutUint64(raw, v)
+		} else {
+			binary.BigEndian.PutUint64(raw, v)
+		}
+		b = append(b, raw...)
+	}
+	return collectdPart(collectdValues, b)
+}
+
+func collectdPacket() []byte {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, 1596819659<<30|1<<29)
+	var b []byte
+	b = append(b, collectdStringPart(collectdHost, "web01")...)
+	b = append(b, collectdPart(collectdTimeHR, ts)...)
+	b = append(b, collectdStringPart(collectdPlugin, "interface")...)
+	b = append(b, collectdStringPart(collectdPluginInstance, "eth0")...)
+	b = append(b, collectdStringPart(collectdType, "if_octets")...)
+	b = append(b, collectdStringPart(collectdTypeInstance, "")...)
+	b = append(b, collectdValuesPart([]byte{collectdDerive, collectdDerive}, []uint64{1024, 2048})...)
+	b = append(b, collectdStringPart(collectdPlugin, "cpu")...)
+	b = append(b, collectdStringPart(collectdPluginInstance, "")...)
+	b = append(b, collectdStringPart(collectdType, "percent")...)
+	b = append(b, collectdStringPart(collectdTypeInstance, "idle")...)
+	b = append(b, collectdValuesPart([]byte{collectdGauge}, []uint64{math.Float64bits(98.5)})...)
+	return b
+}
+
+func TestCollectdParser(t *testing.T) {
+	types := make(CollectdTypes)
+	err := types.Parse(strings.NewReader("# comment\nif_octets  rx:DERIVE:0:U, tx:DERIVE:0:U\npercent value:GAUGE:0:100.1\n"))
+	if err != nil {
+		t.Fatalf("parse types error: %s", err)
+	}
+	want := []string{
+		"interface_if_octets,host=web01,instance=eth0 rx=1024,tx=2048 1596819659500000000",
+		"cpu_percent,host=web01,type_instance=idle value=98.5 1596819659500000000",
+	}
+	users := map[string]string{"alice": "secret"}
+	packet := collectdPacket()
+
+	signed := make([]byte, sha256.Size, sha256.Size+5)
+	signed = append(signed, "alice"...)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(signed[sha256.Size:])
+	mac.Write(packet)
+	copy(signed, mac.Sum(nil))
+	signed = append(collectdPart(collectdSignature, signed), packet...)
+
+	checksum := sha1.Sum(packet)
+	plain := append(checksum[:], packet...)
+	key := sha256.Sum256([]byte("secret"))
+	block, _ := aes.NewCipher(key[:])
+	iv := make([]byte, aes.BlockSize)
+	encrypted := []byte{0, 5}
+	encrypted = append(encrypted, "alice"...)
+	encrypted = append(encrypted, iv...)
+	data := make([]byte, len(plain))
+	cipher.NewOFB(block, iv).XORKeyStream(data, plain)
+	encrypted = collectdPart(collectdEncryption, append(encrypted, data...))
+
+	tests := []struct {
+		name   string
+		level  string
+		packet []byte
+		err    error
+	}{
+		{name: "none", level: CollectdSecurityNone, packet: packet},
+		{name: "sign_unsigned", level: CollectdSecuritySign, packet: packet, err: ErrCollectdSecurityLevel},
+		{name: "sign_signed", level: CollectdSecuritySign, packet: signed},
+		{name: "sign_encrypted", level: CollectdSecuritySign, packet: encrypted},
+		{name: "encrypt_signed", level: CollectdSecurityEncrypt, packet: signed, err: ErrCollectdSecurityLevel},
+		{name: "encrypt_encrypted", level: CollectdSecurityEncrypt, packet: encrypted},
+	}
+	for _, tt := range tests {
+		cp, _ := NewCollectdParser(types, users, tt.level)
+		lines, err := cp.Parse(tt.packet)
+		if err != tt.err {
+			t.Errorf("%v: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(lines) != len(want) {
+			t.Errorf("%v: got %d lines, want %d", tt.name, len(lines), len(want))
+			continue
+		}
+		for i, line := range lines {
+			if string(line) != want[i] {
+				t.Errorf("%v: got %s, want %s", tt.name, line, want[i])
+			}
+		}
+	}
+
+	cp, _ := NewCollectdParser(types, map[string]string{"alice": "wrong"}, CollectdSecuritySign)
+	if _, err := cp.Parse(signed); err != ErrCollectdInvalidSign {
+		t.Errorf("expect ErrCollectdInvalidSign, got %v", err)
+	}
+	if _, err := cp.Parse(encrypted); err != ErrCollectdInvalidEncrypt {
+		t.Errorf("expect ErrCollectdInvalidEncrypt, got %v", err)
+	}
+	cp, _ = NewCollectdParser(types, nil, CollectdSecurityNone)
+	if _, err := cp.Parse(packet[:len(packet)-3]); err != ErrCollectdInvalidPart {
+		t.Errorf("expect ErrCollectdInvalidPart, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ package backend
 
 import (
 	"errors"
+	"fmt"
 	"log"
 
 	"github.com/chengshiwen/influx-proxy/util"
@@ -19,19 +20,35 @@ var (
 )
 
 var (
-	ErrEmptyCircles          = errors.New("circles cannot be empty")
-	ErrEmptyBackends         = errors.New("backends cannot be empty")
-	ErrEmptyBackendName      = errors.New("backend name cannot be empty")
-	ErrDuplicatedBackendName = errors.New("backend name duplicated")
-	ErrInvalidHashKey        = errors.New("invalid hash_key, require idx, exi, name or url")
+	ErrEmptyCircles           = errors.New("circles cannot be empty")
+	ErrEmptyBackends          = errors.New("backends cannot be empty")
+	ErrEmptyBackendName       = errors.New("backend name cannot be empty")
+	ErrDuplicatedBackendName  = errors.New("backend name duplicated")
+	ErrInvalidHashKey         = errors.New("invalid hash_key, require idx, exi, name or url")
+	ErrInvalidWriteValidation = errors.New("invalid write_validation, require rapid or strict")
+	ErrInvalidOverflowAction  = errors.New("invalid overflow_action, require spill or reject")
+	ErrInvalidOverflowStatus  = errors.New("invalid overflow_status, require 429 or 503")
+	ErrInvalidShardRule       = errors.New("invalid shard_rules, require measurement and tags")
+	ErrInvalidBucketMapping   = errors.New("invalid bucket_mapping, require bucket and database")
+	ErrInvalidFlushPolicy     = errors.New("invalid flush_policies, require database and non-negative thresholds")
+	ErrDuplicatedFlushPolicy  = errors.New("flush_policies duplicated with the same database and retention_policy")
+	ErrInvalidGraphiteProto   = errors.New("invalid graphite protocol, require tcp or udp")
+	ErrInvalidLineProtocol    = errors.New("invalid line_protocol, require protocol tcp or udp and database")
+	ErrInvalidLinePrecision   = errors.New("invalid line_protocol precision, require ns, u, ms, s, m or h")
+	ErrInvalidCollectdSecure  = errors.New("invalid collectd security_level, require none, sign or encrypt")
+	ErrInvalidCollectdAuth    = errors.New("invalid collectd, auth_file is required by security_level sign or encrypt")
+	ErrInvalidStatsdProto     = errors.New("invalid statsd protocol, require tcp or udp")
+	ErrInvalidStatsdPercent   = errors.New("invalid statsd percentiles, require in (0, 100]")
 )
 
 type BackendConfig struct { // nolint:golint
-	Name        string `mapstructure:"name"`
-	Url         string `mapstructure:"url"` // nolint:golint
-	Username    string `mapstructure:"username"`
-	Password    string `mapstructure:"password"`
-	AuthEncrypt bool   `mapstructure:"auth_encrypt"`
+	Name             string `mapstructure:"name"`
+	Url              string `mapstructure:"url"` // nolint:golint
+	Username         string `mapstructure:"username"`
+	Password         string `mapstructure:"password"`
+	AuthEncrypt      bool   `mapstructure:"auth_encrypt"`
+	Compression      string `mapstructure:"compression"`
+	CompressionLevel int    `mapstructure:"compression_level"`
 }
 
 type CircleConfig struct {
@@ -39,32 +56,159 @@ type CircleConfig struct {
 	Backends []*BackendConfig `mapstructure:"backends"`
 }
 
+type ShardRuleConfig struct {
+	Database    string   `mapstructure:"database"`
+	Measurement string   `mapstructure:"measurement"`
+	Tags        []string `mapstructure:"tags"`
+}
+
+type WriteRuleConfig struct {
+	Database          string   `mapstructure:"database"`
+	Measurement       string   `mapstructure:"measurement"`
+	RenameMeasurement string   `mapstructure:"rename_measurement"`
+	AddTags           []string `mapstructure:"add_tags"`
+	DropTags          []string `mapstructure:"drop_tags"`
+	RenameTags        []string `mapstructure:"rename_tags"`
+	DropFields        []string `mapstructure:"drop_fields"`
+	RenameFields      []string `mapstructure:"rename_fields"`
+	Lowercase         bool     `mapstructure:"lowercase"`
+}
+
+type FilterRuleConfig struct {
+	Name                    string   `mapstructure:"name"`
+	Action                  string   `mapstructure:"action"`
+	Database                string   `mapstructure:"database"`
+	RetentionPolicy         string   `mapstructure:"retention_policy"`
+	Measurement             string   `mapstructure:"measurement"`
+	Tags                    []string `mapstructure:"tags"`
+	RedirectDatabase        string   `mapstructure:"redirect_database"`
+	RedirectRetentionPolicy string   `mapstructure:"redirect_retention_policy"`
+}
+
+type BucketMappingConfig struct {
+	Bucket          string `mapstructure:"bucket"`
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+}
+
+type FlushPolicyConfig struct {
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+	FlushSize       int    `mapstructure:"flush_size"`
+	FlushTime       int    `mapstructure:"flush_time"`
+	FlushTimeMs     int    `mapstructure:"flush_time_ms"`
+	FlushBytes      int    `mapstructure:"flush_bytes"`
+}
+
+type OpenTSDBConfig struct {
+	Enabled         bool   `mapstructure:"enabled"`
+	BindAddr        string `mapstructure:"bind_addr"`
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+}
+
+type GraphiteConfig struct {
+	Enabled         bool     `mapstructure:"enabled"`
+	BindAddr        string   `mapstructure:"bind_addr"`
+	Protocol        string   `mapstructure:"protocol"`
+	Database        string   `mapstructure:"database"`
+	RetentionPolicy string   `mapstructure:"retention_policy"`
+	Separator       string   `mapstructure:"separator"`
+	Templates       []string `mapstructure:"templates"`
+	Tags            []string `mapstructure:"tags"`
+	UDPReadBuffer   int      `mapstructure:"udp_read_buffer"`
+}
+
+type LineProtocolConfig struct {
+	Enabled         bool   `mapstructure:"enabled"`
+	BindAddr        string `mapstructure:"bind_addr"`
+	Protocol        string `mapstructure:"protocol"`
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+	Precision       string `mapstructure:"precision"`
+	ReadBuffer      int    `mapstructure:"read_buffer"`
+}
+
+type CollectdConfig struct {
+	Enabled         bool     `mapstructure:"enabled"`
+	BindAddr        string   `mapstructure:"bind_addr"`
+	Database        string   `mapstructure:"database"`
+	RetentionPolicy string   `mapstructure:"retention_policy"`
+	TypesDB         []string `mapstructure:"typesdb"`
+	SecurityLevel   string   `mapstructure:"security_level"`
+	AuthFile        string   `mapstructure:"auth_file"`
+	ReadBuffer      int      `mapstructure:"read_buffer"`
+}
+
+type StatsdConfig struct {
+	Enabled         bool      `mapstructure:"enabled"`
+	BindAddr        string    `mapstructure:"bind_addr"`
+	Protocol        string    `mapstructure:"protocol"`
+	Database        string    `mapstructure:"database"`
+	RetentionPolicy string    `mapstructure:"retention_policy"`
+	FlushInterval   int       `mapstructure:"flush_interval"`
+	Percentiles     []float64 `mapstructure:"percentiles"`
+	ReadBuffer      int       `mapstructure:"read_buffer"`
+}
+
+type OTLPConfig struct {
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+}
+
 type ProxyConfig struct {
-	Circles         []*CircleConfig `mapstructure:"circles"`
-	ListenAddr      string          `mapstructure:"listen_addr"`
-	DBList          []string        `mapstructure:"db_list"`
-	DataDir         string          `mapstructure:"data_dir"`
-	TLogDir         string          `mapstructure:"tlog_dir"`
-	HashKey         string          `mapstructure:"hash_key"`
-	FlushSize       int             `mapstructure:"flush_size"`
-	FlushTime       int             `mapstructure:"flush_time"`
-	CheckInterval   int             `mapstructure:"check_interval"`
-	RewriteInterval int             `mapstructure:"rewrite_interval"`
-	ConnPoolSize    int             `mapstructure:"conn_pool_size"`
-	WriteTimeout    int             `mapstructure:"write_timeout"`
-	IdleTimeout     int             `mapstructure:"idle_timeout"`
-	Username        string          `mapstructure:"username"`
-	Password        string          `mapstructure:"password"`
-	AuthEncrypt     bool            `mapstructure:"auth_encrypt"`
-	WriteTracing    bool            `mapstructure:"write_tracing"`
-	QueryTracing    bool            `mapstructure:"query_tracing"`
-	HTTPSEnabled    bool            `mapstructure:"https_enabled"`
-	HTTPSCert       string          `mapstructure:"https_cert"`
-	HTTPSKey        string          `mapstructure:"https_key"`
+	Circles           []*CircleConfig        `mapstructure:"circles"`
+	ListenAddr        string                 `mapstructure:"listen_addr"`
+	DBList            []string               `mapstructure:"db_list"`
+	DataDir           string                 `mapstructure:"data_dir"`
+	BacklogCodec      string                 `mapstructure:"backlog_compression"`
+	BacklogCodecLevel int                    `mapstructure:"backlog_compression_level"`
+	WALEnabled        bool                   `mapstructure:"wal_enabled"`
+	TLogDir           string                 `mapstructure:"tlog_dir"`
+	HashKey           string                 `mapstructure:"hash_key"`
+	ShardRules        []*ShardRuleConfig     `mapstructure:"shard_rules"`
+	WriteRules        []*WriteRuleConfig     `mapstructure:"write_rules"`
+	FilterRules       []*FilterRuleConfig    `mapstructure:"filter_rules"`
+	FlushSize         int                    `mapstructure:"flush_size"`
+	FlushTime         int                    `mapstructure:"flush_time"`
+	FlushBytes        int                    `mapstructure:"flush_bytes"`
+	FlushPolicies     []*FlushPolicyConfig   `mapstructure:"flush_policies"`
+	CheckInterval     int                    `mapstructure:"check_interval"`
+	RewriteInterval   int                    `mapstructure:"rewrite_interval"`
+	ConnPoolSize      int                    `mapstructure:"conn_pool_size"`
+	WriteTimeout      int                    `mapstructure:"write_timeout"`
+	IdleTimeout       int                    `mapstructure:"idle_timeout"`
+	ShutdownTimeout   int                    `mapstructure:"shutdown_timeout"`
+	WriteValidation   string                 `mapstructure:"write_validation"`
+	MaxBodySize       int                    `mapstructure:"max_body_size"`
+	MaxLineSize       int                    `mapstructure:"max_line_size"`
+	MaxInflightPoints int                    `mapstructure:"max_inflight_points"`
+	MaxInflightBytes  int                    `mapstructure:"max_inflight_bytes"`
+	OverflowAction    string                 `mapstructure:"overflow_action"`
+	OverflowStatus    int                    `mapstructure:"overflow_status"`
+	RetryAfter        int                    `mapstructure:"retry_after"`
+	PromMeasurement   string                 `mapstructure:"prom_measurement"`
+	BucketMapping     []*BucketMappingConfig `mapstructure:"bucket_mapping"`
+	OpenTSDB          *OpenTSDBConfig        `mapstructure:"opentsdb"`
+	OTLP              *OTLPConfig            `mapstructure:"otlp"`
+	Graphite          []*GraphiteConfig      `mapstructure:"graphite"`
+	LineProtocol      []*LineProtocolConfig  `mapstructure:"line_protocol"`
+	Collectd          []*CollectdConfig      `mapstructure:"collectd"`
+	Statsd            []*StatsdConfig        `mapstructure:"statsd"`
+	Username          string                 `mapstructure:"username"`
+	Password          string                 `mapstructure:"password"`
+	AuthEncrypt       bool                   `mapstructure:"auth_encrypt"`
+	WriteTracing      bool                   `mapstructure:"write_tracing"`
+	QueryTracing      bool                   `mapstructure:"query_tracing"`
+	HTTPSEnabled      bool                   `mapstructure:"https_enabled"`
+	HTTPSCert         string                 `mapstructure:"https_cert"`
+	HTTPSKey          string                 `mapstructure:"https_key"`
+
+	file string
 }
 
 func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
-	cfg = &ProxyConfig{}
+	cfg = &ProxyConfig{file: cfgfile}
 	viper.SetConfigFile(cfgfile)
 	err = viper.ReadInConfig()
 	if err != nil {
@@ -101,6 +245,9 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.FlushTime <= 0 {
 		cfg.FlushTime = 1
 	}
+	if cfg.FlushBytes < 0 {
+		cfg.FlushBytes = 0
+	}
 	if cfg.CheckInterval <= 0 {
 		cfg.CheckInterval = 1
 	}
@@ -116,6 +263,101 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.IdleTimeout <= 0 {
 		cfg.IdleTimeout = 10
 	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 30
+	}
+	if cfg.WriteValidation == "" {
+		cfg.WriteValidation = "rapid"
+	}
+	if cfg.MaxBodySize < 0 {
+		cfg.MaxBodySize = 0
+	}
+	if cfg.MaxLineSize <= 0 {
+		cfg.MaxLineSize = 1048576
+	}
+	if cfg.MaxInflightPoints < 0 {
+		cfg.MaxInflightPoints = 0
+	}
+	if cfg.MaxInflightBytes < 0 {
+		cfg.MaxInflightBytes = 0
+	}
+	if cfg.OverflowAction == "" {
+		cfg.OverflowAction = "spill"
+	}
+	if cfg.OverflowStatus == 0 {
+		cfg.OverflowStatus = 503
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = 1
+	}
+	if cfg.OpenTSDB == nil {
+		cfg.OpenTSDB = &OpenTSDBConfig{}
+	}
+	if cfg.OpenTSDB.BindAddr == "" {
+		cfg.OpenTSDB.BindAddr = ":4242"
+	}
+	if cfg.OpenTSDB.Database == "" {
+		cfg.OpenTSDB.Database = "opentsdb"
+	}
+	if cfg.OTLP == nil {
+		cfg.OTLP = &OTLPConfig{}
+	}
+	if cfg.OTLP.Database == "" {
+		cfg.OTLP.Database = "otlp"
+	}
+	for _, graphite := range cfg.Graphite {
+		if graphite.BindAddr == "" {
+			graphite.BindAddr = ":2003"
+		}
+		if graphite.Protocol == "" {
+			graphite.Protocol = "tcp"
+		}
+		if graphite.Database == "" {
+			graphite.Database = "graphite"
+		}
+		if graphite.Separator == "" {
+			graphite.Separator = "."
+		}
+	}
+	for _, lp := range cfg.LineProtocol {
+		if lp.BindAddr == "" {
+			lp.BindAddr = ":8089"
+		}
+		if lp.Protocol == "" {
+			lp.Protocol = "udp"
+		}
+		if lp.Precision == "" {
+			lp.Precision = "ns"
+		}
+	}
+	for _, collectd := range cfg.Collectd {
+		if collectd.BindAddr == "" {
+			collectd.BindAddr = ":25826"
+		}
+		if collectd.Database == "" {
+			collectd.Database = "collectd"
+		}
+		if collectd.SecurityLevel == "" {
+			collectd.SecurityLevel = CollectdSecurityNone
+		}
+	}
+	for _, statsd := range cfg.Statsd {
+		if statsd.BindAddr == "" {
+			statsd.BindAddr = ":8125"
+		}
+		if statsd.Protocol == "" {
+			statsd.Protocol = "udp"
+		}
+		if statsd.Database == "" {
+			statsd.Database = "statsd"
+		}
+		if statsd.FlushInterval <= 0 {
+			statsd.FlushInterval = cfg.FlushTime
+		}
+		if statsd.Percentiles == nil {
+			statsd.Percentiles = []float64{90}
+		}
+	}
 }
 
 func (cfg *ProxyConfig) checkConfig() (err error) {
@@ -135,11 +377,93 @@ func (cfg *ProxyConfig) checkConfig() (err error) {
 				return ErrDuplicatedBackendName
 			}
 			set.Add(backend.Name)
+			if _, err = NewCodec(backend.Compression, backend.CompressionLevel); err != nil {
+				return fmt.Errorf("backend %s: %s", backend.Name, err)
+			}
 		}
 	}
+	if _, err = NewCodec(cfg.BacklogCodec, cfg.BacklogCodecLevel); err != nil {
+		return fmt.Errorf("backlog: %s", err)
+	}
 	if cfg.HashKey != "idx" && cfg.HashKey != "exi" && cfg.HashKey != "name" && cfg.HashKey != "url" {
 		return ErrInvalidHashKey
 	}
+	for _, rule := range cfg.ShardRules {
+		if rule.Measurement == "" || len(rule.Tags) == 0 {
+			return ErrInvalidShardRule
+		}
+	}
+	if _, err = NewFilterRules(cfg.FilterRules); err != nil {
+		return
+	}
+	for _, rule := range cfg.WriteRules {
+		if _, err = NewWriteRule(rule); err != nil {
+			return
+		}
+	}
+	for _, mapping := range cfg.BucketMapping {
+		if mapping.Bucket == "" || mapping.Database == "" {
+			return ErrInvalidBucketMapping
+		}
+	}
+	policies := make(map[string]bool)
+	for _, policy := range cfg.FlushPolicies {
+		if policy.Database == "" || policy.FlushSize < 0 || policy.FlushTime < 0 || policy.FlushTimeMs < 0 || policy.FlushBytes < 0 {
+			return ErrInvalidFlushPolicy
+		}
+		key := GetKey(policy.Database, policy.RetentionPolicy)
+		if policies[key] {
+			return ErrDuplicatedFlushPolicy
+		}
+		policies[key] = true
+	}
+	for _, graphite := range cfg.Graphite {
+		if graphite.Protocol != "tcp" && graphite.Protocol != "udp" {
+			return ErrInvalidGraphiteProto
+		}
+		if _, err = NewGraphiteParser(graphite.Separator, graphite.Templates, graphite.Tags); err != nil {
+			return
+		}
+	}
+	for _, lp := range cfg.LineProtocol {
+		if (lp.Protocol != "tcp" && lp.Protocol != "udp") || lp.Database == "" {
+			return ErrInvalidLineProtocol
+		}
+		switch lp.Precision {
+		case "ns", "n", "u", "ms", "s", "m", "h":
+		default:
+			return ErrInvalidLinePrecision
+		}
+	}
+	for _, collectd := range cfg.Collectd {
+		switch collectd.SecurityLevel {
+		case CollectdSecurityNone, CollectdSecuritySign, CollectdSecurityEncrypt:
+		default:
+			return ErrInvalidCollectdSecure
+		}
+		if collectd.SecurityLevel != CollectdSecurityNone && collectd.AuthFile == "" {
+			return ErrInvalidCollectdAuth
+		}
+	}
+	for _, statsd := range cfg.Statsd {
+		if statsd.Protocol != "tcp" && statsd.Protocol != "udp" {
+			return ErrInvalidStatsdProto
+		}
+		for _, p := range statsd.Percentiles {
+			if p <= 0 || p > 100 {
+				return ErrInvalidStatsdPercent
+			}
+		}
+	}
+	if cfg.WriteValidation != "rapid" && cfg.WriteValidation != "strict" {
+		return ErrInvalidWriteValidation
+	}
+	if cfg.OverflowAction != "spill" && cfg.OverflowAction != "reject" {
+		return ErrInvalidOverflowAction
+	}
+	if cfg.OverflowStatus != 429 && cfg.OverflowStatus != 503 {
+		return ErrInvalidOverflowStatus
+	}
 	return
 }
 
@@ -149,8 +473,50 @@ func (cfg *ProxyConfig) PrintSummary() {
 		log.Printf("circle %d: %d backends loaded", id, len(circle.Backends))
 	}
 	log.Printf("hash key: %s", cfg.HashKey)
+	for _, rule := range cfg.ShardRules {
+		log.Printf("shard rule: db %q, measurement %q, tags %v", rule.Database, rule.Measurement, rule.Tags)
+	}
+	if len(cfg.FilterRules) > 0 {
+		log.Printf("filter rules: %d loaded", len(cfg.FilterRules))
+	}
+	if len(cfg.WriteRules) > 0 {
+		log.Printf("write rules: %d loaded", len(cfg.WriteRules))
+	}
+	if cfg.WALEnabled {
+		log.Printf("wal enabled: %s", cfg.DataDir)
+	}
+	if len(cfg.FlushPolicies) > 0 {
+		log.Printf("flush policies: %d loaded", len(cfg.FlushPolicies))
+	}
+	log.Printf("write validation: %s", cfg.WriteValidation)
+	if cfg.MaxInflightPoints > 0 || cfg.MaxInflightBytes > 0 {
+		log.Printf("max inflight points: %d, bytes: %d, overflow action: %s", cfg.MaxInflightPoints, cfg.MaxInflightBytes, cfg.OverflowAction)
+	}
 	if len(cfg.DBList) > 0 {
 		log.Printf("db list: %v", cfg.DBList)
 	}
+	if cfg.OpenTSDB.Enabled {
+		log.Printf("opentsdb: %s, db: %s, rp: %s", cfg.OpenTSDB.BindAddr, cfg.OpenTSDB.Database, cfg.OpenTSDB.RetentionPolicy)
+	}
+	for _, graphite := range cfg.Graphite {
+		if graphite.Enabled {
+			log.Printf("graphite: %s/%s, db: %s, rp: %s, templates: %d", graphite.Protocol, graphite.BindAddr, graphite.Database, graphite.RetentionPolicy, len(graphite.Templates))
+		}
+	}
+	for _, lp := range cfg.LineProtocol {
+		if lp.Enabled {
+			log.Printf("line protocol: %s/%s, db: %s, rp: %s, precision: %s", lp.Protocol, lp.BindAddr, lp.Database, lp.RetentionPolicy, lp.Precision)
+		}
+	}
+	for _, collectd := range cfg.Collectd {
+		if collectd.Enabled {
+			log.Printf("collectd: %s, db: %s, rp: %s, security level: %s", collectd.BindAddr, collectd.Database, collectd.RetentionPolicy, collectd.SecurityLevel)
+		}
+	}
+	for _, statsd := range cfg.Statsd {
+		if statsd.Enabled {
+			log.Printf("statsd: %s/%s, db: %s, rp: %s, flush interval: %ds", statsd.Protocol, statsd.BindAddr, statsd.Database, statsd.RetentionPolicy, statsd.FlushInterval)
+		}
+	}
 	log.Printf("auth: %t, encrypt: %t", cfg.Username != "" || cfg.Password != "", cfg.AuthEncrypt)
 }
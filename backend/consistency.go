@@ -0,0 +1,203 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidConsistency = errors.New("invalid consistency, require any, one, quorum or all")
+	ErrWriteTimeout       = errors.New("timeout")
+)
+
+type ConsistencyLevel int
+
+const (
+	ConsistencyNone ConsistencyLevel = iota
+	ConsistencyAny
+	ConsistencyOne
+	ConsistencyQuorum
+	ConsistencyAll
+)
+
+func ParseConsistencyLevel(level string) (ConsistencyLevel, error) {
+	switch level {
+	case "":
+		return ConsistencyNone, nil
+	case "any":
+		return ConsistencyAny, nil
+	case "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	default:
+		return ConsistencyNone, ErrInvalidConsistency
+	}
+}
+
+func (cl ConsistencyLevel) String() string {
+	switch cl {
+	case ConsistencyAny:
+		return "any"
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	default:
+		return ""
+	}
+}
+
+type FlushState int
+
+const (
+	FlushWritten FlushState = iota
+	FlushBacklogged
+	FlushDropped
+)
+
+// WriteAck tracks the points of one write request sent to one circle
+type WriteAck struct {
+	lock       sync.Mutex
+	pending    int
+	sealed     bool
+	backlogged int
+	dropped    int
+	done       chan struct{}
+}
+
+func NewWriteAck() *WriteAck {
+	return &WriteAck{done: make(chan struct{})}
+}
+
+func (wa *WriteAck) Add(n int) {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	wa.pending += n
+}
+
+func (wa *WriteAck) Done(n int, state FlushState) {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	wa.pending -= n
+	switch state {
+	case FlushBacklogged:
+		wa.backlogged += n
+	case FlushDropped:
+		wa.dropped += n
+	}
+	wa.tryClose()
+}
+
+func (wa *WriteAck) Seal() {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	wa.sealed = true
+	wa.tryClose()
+}
+
+func (wa *WriteAck) tryClose() {
+	if wa.sealed && wa.pending <= 0 {
+		select {
+		case <-wa.done:
+		default:
+			close(wa.done)
+		}
+	}
+}
+
+// State returns the worst state of the points, it's only meaningful after done
+func (wa *WriteAck) State() FlushState {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	if wa.dropped > 0 || wa.pending > 0 {
+		return FlushDropped
+	}
+	if wa.backlogged > 0 {
+		return FlushBacklogged
+	}
+	return FlushWritten
+}
+
+// WriteTracker tracks a write request until its points are acknowledged by the circles
+type WriteTracker struct {
+	level   ConsistencyLevel
+	timeout time.Duration
+	acks    []*WriteAck
+}
+
+func NewWriteTracker(level ConsistencyLevel, circles int, timeout time.Duration) (wt *WriteTracker) {
+	wt = &WriteTracker{
+		level:   level,
+		timeout: timeout,
+		acks:    make([]*WriteAck, circles),
+	}
+	for i := range wt.acks {
+		wt.acks[i] = NewWriteAck()
+	}
+	return
+}
+
+func (wt *WriteTracker) Ack(circleId int) *WriteAck { // nolint:golint
+	return wt.acks[circleId]
+}
+
+func (wt *WriteTracker) Wait(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, wt.timeout)
+	defer cancel()
+	timeout := false
+	for _, ack := range wt.acks {
+		ack.Seal()
+		if timeout {
+			continue
+		}
+		select {
+		case <-ack.done:
+		case <-ctx.Done():
+			timeout = true
+		}
+	}
+
+	written, backlogged := 0, 0
+	for _, ack := range wt.acks {
+		switch ack.State() {
+		case FlushWritten:
+			written++
+		case FlushBacklogged:
+			backlogged++
+		}
+	}
+	total := len(wt.acks)
+	var met bool
+	switch wt.level {
+	case ConsistencyAny:
+		met = written+backlogged > 0
+	case ConsistencyOne:
+		met = written > 0
+	case ConsistencyQuorum:
+		met = written > total/2
+	default:
+		met = written == total
+	}
+	if met {
+		return nil
+	}
+	if written+backlogged == 0 {
+		if timeout {
+			return fmt.Errorf("write failed: %s", ErrWriteTimeout)
+		}
+		return fmt.Errorf("write failed: no circle accepted the data")
+	}
+	return fmt.Errorf("partial write: consistency %s not met, written %d/%d circles, backlogged %d", wt.level, written, total, backlogged)
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTracker(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  ConsistencyLevel
+		states []FlushState
+		want   string
+	}{
+		{
+			name:   "all",
+			level:  ConsistencyAll,
+			states: []FlushState{FlushWritten, FlushWritten, FlushWritten},
+			want:   "",
+		},
+		{
+			name:   "all_partial",
+			level:  ConsistencyAll,
+			states: []FlushState{FlushWritten, FlushBacklogged, FlushWritten},
+			want:   "partial write",
+		},
+		{
+			name:   "quorum",
+			level:  ConsistencyQuorum,
+			states: []FlushState{FlushWritten, FlushDropped, FlushWritten},
+			want:   "",
+		},
+		{
+			name:   "quorum_partial",
+			level:  ConsistencyQuorum,
+			states: []FlushState{FlushWritten, FlushDropped, FlushBacklogged},
+			want:   "partial write",
+		},
+		{
+			name:   "one",
+			level:  ConsistencyOne,
+			states: []FlushState{FlushDropped, FlushWritten, FlushDropped},
+			want:   "",
+		},
+		{
+			name:   "any",
+			level:  ConsistencyAny,
+			states: []FlushState{FlushDropped, FlushBacklogged, FlushDropped},
+			want:   "",
+		},
+		{
+			name:   "any_failed",
+			level:  ConsistencyAny,
+			states: []FlushState{FlushDropped, FlushDropped, FlushDropped},
+			want:   "write failed",
+		},
+	}
+	for _, tt := range tests {
+		wt := NewWriteTracker(tt.level, len(tt.states), time.Second)
+		for i, state := range tt.states {
+			wt.Ack(i).Add(2)
+			go wt.Ack(i).Done(2, state)
+		}
+		err := wt.Wait(context.Background())
+		if (tt.want == "" && err != nil) || (tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want))) {
+			t.Errorf("%v: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestWriteTrackerTimeout(t *testing.T) {
+	wt := NewWriteTracker(ConsistencyOne, 2, 10*time.Millisecond)
+	wt.Ack(0).Add(1)
+	wt.Ack(1).Add(1)
+	err := wt.Wait(context.Background())
+	if err == nil || !strings.Contains(err.Error(), ErrWriteTimeout.Error()) {
+		t.Errorf("got %v, want %v", err, ErrWriteTimeout)
+	}
+}
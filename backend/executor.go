@@ -7,7 +7,6 @@ package backend
 import (
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"sync"
 
@@ -29,29 +28,17 @@ func QueryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if err != nil {
 		return nil, ErrGetMeasurement
 	}
-	key := GetKey(db, meas)
-
-	// pass non-active, rewriting or write-only.
-	perms := rand.Perm(len(ip.Circles))
-	for _, p := range perms {
-		be := ip.Circles[p].GetBackend(key)
-		if !be.IsActive() || be.IsRewriting() || be.IsWriteOnly() {
-			continue
-		}
-		qr := be.Query(req, w, false)
-		if qr.Err == nil {
-			return qr.Body, nil
-		}
-		err = qr.Err
+	if ip.ShardRules.IsSharded(db, meas) {
+		return QueryShardedQL(w, req, ip, tokens)
 	}
+	key := GetKey(db, meas)
 
-	// pass non-active, non-writing (excluding rewriting and write-only).
-	backends := ip.GetBackends(key)
-	for _, be := range backends {
-		if !be.IsActive() || !(be.IsRewriting() || be.IsWriteOnly()) {
-			continue
-		}
-		qr := be.Query(req, w, false)
+	// pass non-active, and try rewriting or write-only at last.
+	circles := ip.queryCircles(func(circle *Circle) []*Backend {
+		return []*Backend{circle.GetBackend(key)}
+	})
+	for _, circle := range circles {
+		qr := circle.GetBackend(key).Query(req, w, false)
 		if qr.Err == nil {
 			return qr.Body, nil
 		}
@@ -115,8 +102,15 @@ func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, to
 	if err != nil {
 		return nil, err
 	}
-	key := GetKey(db, meas)
-	backends := ip.GetBackends(key)
+	var backends []*Backend
+	if ip.ShardRules.IsSharded(db, meas) {
+		// sharded measurement is stored in all backends
+		for _, circle := range ip.Circles {
+			backends = append(backends, circle.Backends...)
+		}
+	} else {
+		backends = ip.GetBackends(GetKey(db, meas))
+	}
 	if len(backends) == 0 {
 		return nil, ErrGetBackends
 	}
@@ -213,6 +213,8 @@ func (fb *FileBackend) CleanUp() (err error) {
 }
 
 func (fb *FileBackend) Close() {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
 	fb.producer.Close()
 	fb.consumer.Close()
 	fb.meta.Close()
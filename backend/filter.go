@@ -0,0 +1,139 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const (
+	FilterAllow    = "allow"
+	FilterDeny     = "deny"
+	FilterRedirect = "redirect"
+)
+
+var ErrRedirectForbidden = errors.New("redirect database forbidden")
+
+// FilterRule matches the points by db, rp, measurement and tags, the first matched rule decides the action
+type FilterRule struct {
+	points      int64 // keep first for 64-bit alignment of atomic operations
+	Name        string
+	Action      string
+	database    string
+	rp          string
+	measurement *regexp.Regexp
+	tags        [][2]string
+	redirectDb  string
+	redirectRp  string
+}
+
+type FilterRuleStats struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Points int64  `json:"points"`
+}
+
+func NewFilterRule(cfg *FilterRuleConfig, idx int) (fr *FilterRule, err error) {
+	fr = &FilterRule{
+		Name:       cfg.Name,
+		Action:     cfg.Action,
+		database:   cfg.Database,
+		rp:         cfg.RetentionPolicy,
+		redirectDb: cfg.RedirectDatabase,
+		redirectRp: cfg.RedirectRetentionPolicy,
+	}
+	if fr.Name == "" {
+		fr.Name = fmt.Sprintf("rule%d", idx)
+	}
+	if fr.Action != FilterAllow && fr.Action != FilterDeny && fr.Action != FilterRedirect {
+		return nil, fmt.Errorf("invalid filter_rules action %q, require allow, deny or redirect", cfg.Action)
+	}
+	if fr.Action == FilterRedirect && fr.redirectDb == "" && fr.redirectRp == "" {
+		return nil, fmt.Errorf("invalid filter_rules %s: redirect requires redirect_database or redirect_retention_policy", fr.Name)
+	}
+	if cfg.Measurement != "" {
+		fr.measurement, err = regexp.Compile(cfg.Measurement)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter_rules measurement: %s", err)
+		}
+	}
+	fr.tags, err = parsePairs(cfg.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter_rules tags: %s", err)
+	}
+	return
+}
+
+func NewFilterRules(cfgs []*FilterRuleConfig) (rules []*FilterRule, err error) {
+	for i, cfg := range cfgs {
+		fr, err := NewFilterRule(cfg, i)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fr)
+	}
+	return
+}
+
+func (fr *FilterRule) Match(db, rp, meas string, line []byte) bool {
+	if fr.database != "" && fr.database != db {
+		return false
+	}
+	if fr.rp != "" && fr.rp != rp {
+		return false
+	}
+	if fr.measurement != nil && !fr.measurement.MatchString(meas) {
+		return false
+	}
+	for _, tag := range fr.tags {
+		value := ScanTagValue(line, tag[0])
+		if value == nil || util.UnescapeTag(string(value)) != tag[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (fr *FilterRule) Stats() *FilterRuleStats {
+	return &FilterRuleStats{
+		Name:   fr.Name,
+		Action: fr.Action,
+		Points: atomic.LoadInt64(&fr.points),
+	}
+}
+
+// ApplyFilterRules returns the db and rp to write the line, ok is false if the line is denied,
+// the line matching no rule is denied if there is any allow rule
+func ApplyFilterRules(rules []*FilterRule, db, rp, meas string, line []byte) (string, string, bool) {
+	for _, fr := range rules {
+		if !fr.Match(db, rp, meas, line) {
+			continue
+		}
+		atomic.AddInt64(&fr.points, 1)
+		switch fr.Action {
+		case FilterDeny:
+			return db, rp, false
+		case FilterRedirect:
+			if fr.redirectDb != "" {
+				db = fr.redirectDb
+			}
+			if fr.redirectRp != "" {
+				rp = fr.redirectRp
+			}
+		}
+		return db, rp, true
+	}
+	for _, fr := range rules {
+		if fr.Action == FilterAllow {
+			return db, rp, false
+		}
+	}
+	return db, rp, true
+}
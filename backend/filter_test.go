@@ -0,0 +1,68 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestApplyFilterRules(t *testing.T) {
+	cfgs := []*FilterRuleConfig{
+		{Name: "keep-prod", Action: "allow", Database: "db1", Tags: []string{"env=prod"}},
+		{Name: "drop-debug", Action: "deny", Measurement: "^debug_"},
+		{Name: "archive", Action: "redirect", Database: "db1", Measurement: "^old_", RedirectDatabase: "archive", RedirectRetentionPolicy: "cold"},
+		{Name: "drop-test", Action: "deny", Tags: []string{"env=test 1"}},
+	}
+	rules, err := NewFilterRules(cfgs)
+	if err != nil {
+		t.Fatalf("NewFilterRules error: %s", err)
+	}
+	tests := []struct {
+		name   string
+		db     string
+		rp     string
+		line   string
+		wantDb string
+		wantRp string
+		wantOk bool
+	}{
+		{name: "allow", db: "db1", line: "debug_cpu,env=prod value=1 1596819659", wantDb: "db1", wantOk: true},
+		{name: "deny", db: "db1", line: "debug_cpu,env=dev value=1 1596819659", wantDb: "db1", wantOk: false},
+		{name: "redirect", db: "db1", rp: "autogen", line: "old_cpu value=1 1596819659", wantDb: "archive", wantRp: "cold", wantOk: true},
+		{name: "unmatched", db: "db2", line: "old_cpu value=1 1596819659", wantDb: "db2", wantOk: false},
+		{name: "tag", db: "db2", line: "cpu,env=test\\ 1 value=1 1596819659", wantDb: "db2", wantOk: false},
+	}
+	for _, tt := range tests {
+		line := []byte(tt.line)
+		meas, _ := ScanKey(line)
+		db, rp, ok := ApplyFilterRules(rules, tt.db, tt.rp, meas, line)
+		if db != tt.wantDb || rp != tt.wantRp || ok != tt.wantOk {
+			t.Errorf("%v: got %s %s %t, want %s %s %t", tt.name, db, rp, ok, tt.wantDb, tt.wantRp, tt.wantOk)
+		}
+	}
+	want := []int64{1, 1, 1, 1}
+	for i, fr := range rules {
+		if fr.Stats().Points != want[i] {
+			t.Errorf("rule %s: got %d points, want %d", fr.Name, fr.Stats().Points, want[i])
+		}
+	}
+	if _, _, ok := ApplyFilterRules(rules[1:], "db2", "", "cpu", []byte("cpu value=1")); !ok {
+		t.Error("unmatched: the line should be written without allow rules")
+	}
+}
+
+func TestNewFilterRule(t *testing.T) {
+	invalids := []*FilterRuleConfig{
+		{Action: "drop"},
+		{Action: "redirect"},
+		{Action: "deny", Measurement: "(cpu"},
+		{Action: "deny", Tags: []string{"env"}},
+	}
+	for i, cfg := range invalids {
+		if _, err := NewFilterRule(cfg, i); err == nil {
+			t.Errorf("invalid rule %d: expect error", i)
+		}
+	}
+}
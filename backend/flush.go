@@ -0,0 +1,84 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"time"
+)
+
+// FlushPolicy is the thresholds to flush a buffer, the buffer is flushed when any of them is reached
+type FlushPolicy struct {
+	Size  int
+	Bytes int
+	Time  time.Duration
+}
+
+// Reached reports whether the buffer has reached the size or bytes threshold
+func (fp *FlushPolicy) Reached(cb *CacheBuffer) bool {
+	return cb.Counter >= fp.Size || (fp.Bytes > 0 && cb.Size >= fp.Bytes)
+}
+
+// FlushPolicies is the flush policies of the databases and retention policies
+type FlushPolicies struct {
+	def      *FlushPolicy
+	policies map[string]*FlushPolicy
+}
+
+// NewFlushPolicies creates the policies from flush_policies, the zero thresholds inherit the global ones
+func NewFlushPolicies(cfg *ProxyConfig) *FlushPolicies {
+	fps := &FlushPolicies{
+		def: &FlushPolicy{
+			Size:  cfg.FlushSize,
+			Bytes: cfg.FlushBytes,
+			Time:  time.Duration(cfg.FlushTime) * time.Second,
+		},
+		policies: make(map[string]*FlushPolicy),
+	}
+	for _, pcfg := range cfg.FlushPolicies {
+		fp := *fps.def
+		if pcfg.FlushSize > 0 {
+			fp.Size = pcfg.FlushSize
+		}
+		if pcfg.FlushBytes > 0 {
+			fp.Bytes = pcfg.FlushBytes
+		}
+		if pcfg.FlushTimeMs > 0 {
+			fp.Time = time.Duration(pcfg.FlushTimeMs) * time.Millisecond
+		} else if pcfg.FlushTime > 0 {
+			fp.Time = time.Duration(pcfg.FlushTime) * time.Second
+		}
+		fps.policies[GetKey(pcfg.Database, pcfg.RetentionPolicy)] = &fp
+	}
+	return fps
+}
+
+// Default returns the global policy
+func (fps *FlushPolicies) Default() *FlushPolicy {
+	return fps.def
+}
+
+// MaxTime returns the longest flush time of the policies
+func (fps *FlushPolicies) MaxTime() time.Duration {
+	max := fps.def.Time
+	for _, fp := range fps.policies {
+		if fp.Time > max {
+			max = fp.Time
+		}
+	}
+	return max
+}
+
+// Get returns the policy of db and rp, the policy of db and empty rp applies to all the rps of db
+func (fps *FlushPolicies) Get(db, rp string) *FlushPolicy {
+	if len(fps.policies) > 0 {
+		if fp, ok := fps.policies[GetKey(db, rp)]; ok {
+			return fp
+		}
+		if fp, ok := fps.policies[GetKey(db, "")]; ok {
+			return fp
+		}
+	}
+	return fps.def
+}
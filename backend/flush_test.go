@@ -0,0 +1,52 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlushPolicies(t *testing.T) {
+	cfg := &ProxyConfig{
+		FlushSize:  10000,
+		FlushTime:  1,
+		FlushBytes: 0,
+		FlushPolicies: []*FlushPolicyConfig{
+			{Database: "alerts", FlushSize: 100},
+			{Database: "metrics", RetentionPolicy: "bulk", FlushTime: 10, FlushBytes: 4194304},
+			{Database: "metrics", RetentionPolicy: "realtime", FlushTime: 10, FlushTimeMs: 200},
+		},
+	}
+	fps := NewFlushPolicies(cfg)
+	tests := []struct {
+		db   string
+		rp   string
+		want FlushPolicy
+	}{
+		{"alerts", "", FlushPolicy{Size: 100, Time: time.Second}},
+		{"alerts", "autogen", FlushPolicy{Size: 100, Time: time.Second}},
+		{"metrics", "bulk", FlushPolicy{Size: 10000, Bytes: 4194304, Time: 10 * time.Second}},
+		{"metrics", "realtime", FlushPolicy{Size: 10000, Time: 200 * time.Millisecond}},
+		{"metrics", "autogen", FlushPolicy{Size: 10000, Time: time.Second}},
+	}
+	for _, tt := range tests {
+		if got := fps.Get(tt.db, tt.rp); *got != tt.want {
+			t.Errorf("%s %s: got %+v, want %+v", tt.db, tt.rp, *got, tt.want)
+		}
+	}
+
+	if max := fps.MaxTime(); max != 10*time.Second {
+		t.Errorf("expect max time 10s, got %s", max)
+	}
+
+	fp := fps.Get("metrics", "bulk")
+	if fp.Reached(&CacheBuffer{Counter: 10, Size: 1024}) {
+		t.Error("expect not reached")
+	}
+	if !fp.Reached(&CacheBuffer{Counter: 10, Size: 4194304}) || !fp.Reached(&CacheBuffer{Counter: 10000, Size: 1024}) {
+		t.Error("expect reached")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var (
+	ErrFluxBucketNotFound     = errors.New("flux query requires from(bucket: \"...\")")
+	ErrFluxMultipleBuckets    = errors.New("flux query with multiple buckets is not supported")
+	ErrFluxMeasurementNotOnly = errors.New("flux query requires a single measurement filtered by r._measurement == \"...\"")
+	ErrFluxShardedMeasurement = errors.New("flux query on a sharded measurement is not supported")
+)
+
+var (
+	fluxBucketRegexp      = regexp.MustCompile(`\bfrom\s*\(\s*bucket\s*:\s*("(?:[^"\\]|\\.)*")\s*\)`)
+	fluxMeasurementRegexp = regexp.MustCompile(`\br\s*(?:\.\s*_measurement\b|\[\s*"_measurement"\s*\])\s*(==)?\s*("(?:[^"\\]|\\.)*")?`)
+)
+
+// GetFluxScript returns the flux script in the body of a /api/v2/query request
+func GetFluxScript(body []byte, contentType string) (string, error) {
+	if !strings.HasPrefix(contentType, "application/json") {
+		return string(body), nil
+	}
+	var q struct {
+		Query string `json:"query"`
+	}
+	if err := jsoniter.Unmarshal(body, &q); err != nil {
+		return "", err
+	}
+	return q.Query, nil
+}
+
+// SetFluxScript replaces the flux script in the body of a /api/v2/query request
+func SetFluxScript(body []byte, contentType string, script string) ([]byte, error) {
+	if !strings.HasPrefix(contentType, "application/json") {
+		return []byte(script), nil
+	}
+	var q map[string]interface{}
+	if err := jsoniter.Unmarshal(body, &q); err != nil {
+		return nil, err
+	}
+	q["query"] = script
+	return jsoniter.Marshal(q)
+}
+
+// RewriteFluxBucket replaces the bucket of all from() with the bucket of db and rp
+func RewriteFluxBucket(script, db, rp string) string {
+	bucket := db
+	if rp != "" {
+		bucket = db + "/" + rp
+	}
+	return fluxBucketRegexp.ReplaceAllLiteralString(script, "from(bucket: "+strconv.Quote(bucket)+")")
+}
+
+// ParseFlux extracts the bucket of from() and the measurement of the _measurement equality filter,
+// the script is rejected unless all the buckets and the measurement filters refer to a single one
+func ParseFlux(script string) (bucket, meas string, err error) {
+	for _, m := range fluxBucketRegexp.FindAllStringSubmatch(script, -1) {
+		b, _ := strconv.Unquote(m[1])
+		if bucket != "" && bucket != b {
+			return "", "", ErrFluxMultipleBuckets
+		}
+		bucket = b
+	}
+	if bucket == "" {
+		return "", "", ErrFluxBucketNotFound
+	}
+	for _, m := range fluxMeasurementRegexp.FindAllStringSubmatch(script, -1) {
+		if m[1] == "" || m[2] == "" {
+			return "", "", ErrFluxMeasurementNotOnly
+		}
+		v, err := strconv.Unquote(m[2])
+		if err != nil || (meas != "" && meas != v) {
+			return "", "", ErrFluxMeasurementNotOnly
+		}
+		meas = v
+	}
+	if meas == "" {
+		return "", "", ErrFluxMeasurementNotOnly
+	}
+	return
+}
+
+func QueryFlux(w http.ResponseWriter, req *http.Request, ip *Proxy, body []byte) ([]byte, error) {
+	// all circles -> backend by key(db,meas) -> flux
+	script, err := GetFluxScript(body, req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	bucket, meas, err := ParseFlux(script)
+	if err != nil {
+		return nil, err
+	}
+	db, rp := ip.GetDatabaseFromBucket(bucket)
+	if db == "_internal" || !ip.AllowDatabase(db) {
+		return nil, errors.New("database forbidden: " + db)
+	}
+	if ip.ShardRules.IsSharded(db, meas) {
+		return nil, ErrFluxShardedMeasurement
+	}
+	if _, ok := ip.BucketMapping[bucket]; ok {
+		// the mapped bucket is unknown to the backends
+		body, err = SetFluxScript(body, req.Header.Get("Content-Type"), RewriteFluxBucket(script, db, rp))
+		if err != nil {
+			return nil, err
+		}
+	}
+	key := GetKey(db, meas)
+
+	// pass non-active, and try rewriting or write-only at last.
+	circles := ip.queryCircles(func(circle *Circle) []*Backend {
+		return []*Backend{circle.GetBackend(key)}
+	})
+	for _, circle := range circles {
+		qr := circle.GetBackend(key).QueryFlux(req, w, body)
+		if qr.Err == nil {
+			return qr.Body, nil
+		}
+		err = qr.Err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrBackendsUnavailable
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestParseFlux(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		bucket string
+		meas   string
+		err    error
+	}{
+		{
+			name:   "test1",
+			script: `from(bucket: "telegraf/autogen") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu" and r._field == "usage_idle")`,
+			bucket: "telegraf/autogen",
+			meas:   "cpu",
+		},
+		{
+			name:   "test2",
+			script: "from(bucket:\"db1\")\n  |> range(start: -5m)\n  |> filter(fn: (r) => r[\"_measurement\"] == \"disk \\\"io\\\"\")",
+			bucket: "db1",
+			meas:   `disk "io"`,
+		},
+		{
+			name: "test3",
+			script: `a = from(bucket: "db1") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu")
+b = from(bucket: "db1") |> range(start: -2h) |> filter(fn: (r) => r._measurement == "cpu")
+join(tables: {a: a, b: b}, on: ["_time"])`,
+			bucket: "db1",
+			meas:   "cpu",
+		},
+		{
+			name:   "no_bucket",
+			script: `buckets()`,
+			err:    ErrFluxBucketNotFound,
+		},
+		{
+			name:   "multiple_buckets",
+			script: `from(bucket: "db1") |> filter(fn: (r) => r._measurement == "cpu") |> union(tables: [from(bucket: "db2")])`,
+			err:    ErrFluxMultipleBuckets,
+		},
+		{
+			name:   "no_measurement",
+			script: `from(bucket: "db1") |> range(start: -1h)`,
+			err:    ErrFluxMeasurementNotOnly,
+		},
+		{
+			name:   "regex_measurement",
+			script: `from(bucket: "db1") |> range(start: -1h) |> filter(fn: (r) => r._measurement =~ /cpu.*/)`,
+			err:    ErrFluxMeasurementNotOnly,
+		},
+		{
+			name:   "multiple_measurements",
+			script: `from(bucket: "db1") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu" or r._measurement == "mem")`,
+			err:    ErrFluxMeasurementNotOnly,
+		},
+	}
+	for _, tt := range tests {
+		bucket, meas, err := ParseFlux(tt.script)
+		if bucket != tt.bucket || meas != tt.meas || err != tt.err {
+			t.Errorf("%v: got %q %q %v, want %q %q %v", tt.name, bucket, meas, err, tt.bucket, tt.meas, tt.err)
+		}
+	}
+}
+
+func TestRewriteFluxBucket(t *testing.T) {
+	ip := &Proxy{BucketMapping: map[string][2]string{"metrics": {"telegraf", "autogen"}}}
+	script := `a = from(bucket: "metrics") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu")
+b = from( bucket:"metrics" ) |> range(start: -2h)`
+	bucket, _, err := ParseFlux(script)
+	if err != nil {
+		t.Fatalf("ParseFlux error: %s", err)
+	}
+	db, rp := ip.GetDatabaseFromBucket(bucket)
+	want := `a = from(bucket: "telegraf/autogen") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu")
+b = from(bucket: "telegraf/autogen") |> range(start: -2h)`
+	if got := RewriteFluxBucket(script, db, rp); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := RewriteFluxBucket(`from(bucket: "db1/rp1")`, "db1", ""); got != `from(bucket: "db1")` {
+		t.Errorf("got %q", got)
+	}
+
+	body, err := SetFluxScript([]byte(`{"query": "from(bucket: \"metrics\")", "type": "flux"}`), "application/json", want)
+	if err != nil {
+		t.Fatalf("SetFluxScript error: %s", err)
+	}
+	if script, err = GetFluxScript(body, "application/json"); err != nil || script != want {
+		t.Errorf("got %q %v", script, err)
+	}
+}
+
+func TestGetFluxScript(t *testing.T) {
+	script, err := GetFluxScript([]byte(`{"query": "from(bucket: \"db1\")", "type": "flux"}`), "application/json")
+	if err != nil || script != `from(bucket: "db1")` {
+		t.Errorf("got %q %v", script, err)
+	}
+	script, err = GetFluxScript([]byte(`from(bucket: "db1")`), "application/vnd.flux")
+	if err != nil || script != `from(bucket: "db1")` {
+		t.Errorf("got %q %v", script, err)
+	}
+}
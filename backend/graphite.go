@@ -0,0 +1,261 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const GraphiteDefaultTemplate = "measurement*"
+
+var (
+	ErrGraphiteInvalidLine  = errors.New("invalid graphite line, require <path> <value> [timestamp]")
+	ErrGraphiteEmptyPath    = errors.New("graphite metric path cannot be empty")
+	ErrGraphiteInvalidValue = errors.New("graphite metric has an unsupported value")
+)
+
+// graphiteTemplate converts the elements of a metric path into the measurement, tags and field
+type graphiteTemplate struct {
+	filter []string
+	parts  []string
+	tags   map[string]string
+}
+
+// newGraphiteTemplate parses a template of the form: [filter] <template> [tag1=value1,tag2=value2]
+func newGraphiteTemplate(s string) (tmpl *graphiteTemplate, err error) {
+	fields := strings.Fields(s)
+	tmpl = &graphiteTemplate{tags: make(map[string]string)}
+	var template, tags string
+	switch len(fields) {
+	case 1:
+		template = fields[0]
+	case 2:
+		if strings.Contains(fields[1], "=") {
+			template, tags = fields[0], fields[1]
+		} else {
+			tmpl.filter, template = strings.Split(fields[0], "."), fields[1]
+		}
+	case 3:
+		tmpl.filter, template, tags = strings.Split(fields[0], "."), fields[1], fields[2]
+	default:
+		return nil, fmt.Errorf("invalid graphite template %q", s)
+	}
+
+	tmpl.parts = strings.Split(template, ".")
+	hasMeasurement := false
+	for i, part := range tmpl.parts {
+		if strings.HasSuffix(part, "*") && i != len(tmpl.parts)-1 {
+			return nil, fmt.Errorf("invalid graphite template %q, wildcard must be the last part", s)
+		}
+		if part == "measurement" || part == "measurement*" {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("invalid graphite template %q, no measurement specified", s)
+	}
+	if tags != "" {
+		if tmpl.tags, err = parseGraphiteTags(strings.Split(tags, ",")); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func parseGraphiteTags(pairs []string) (map[string]string, error) {
+	tags := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid graphite tag %q", pair)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+// match reports whether the filter matches the leading elements of the path, an element of the filter could be a glob
+func (tmpl *graphiteTemplate) match(elems []string) bool {
+	if len(tmpl.filter) > len(elems) {
+		return false
+	}
+	for i, f := range tmpl.filter {
+		if ok, _ := path.Match(f, elems[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific reports whether the filter is more specific than the other,
+// an exact element wins over a wildcard element at the first difference, then a longer filter wins
+func (tmpl *graphiteTemplate) moreSpecific(other *graphiteTemplate) bool {
+	for i := 0; i < len(tmpl.filter) && i < len(other.filter); i++ {
+		wild, otherWild := strings.ContainsAny(tmpl.filter[i], "*?["), strings.ContainsAny(other.filter[i], "*?[")
+		if wild != otherWild {
+			return otherWild
+		}
+	}
+	return len(tmpl.filter) > len(other.filter)
+}
+
+func (tmpl *graphiteTemplate) apply(separator string, elems []string) (measurement string, tags map[string]string, field string) {
+	var meas, fields []string
+	tagElems := make(map[string][]string)
+	for i, part := range tmpl.parts {
+		if i >= len(elems) {
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			meas = append(meas, elems[i])
+		case "measurement*":
+			meas = append(meas, elems[i:]...)
+		case "field":
+			fields = append(fields, elems[i])
+		case "field*":
+			fields = append(fields, elems[i:]...)
+		default:
+			tagElems[part] = append(tagElems[part], elems[i])
+		}
+	}
+	if len(meas) == 0 {
+		meas = elems
+	}
+	tags = make(map[string]string, len(tagElems))
+	for k, v := range tagElems {
+		tags[k] = strings.Join(v, separator)
+	}
+	return strings.Join(meas, separator), tags, strings.Join(fields, separator)
+}
+
+// GraphiteParser converts the graphite plaintext lines into the line protocol by the templates
+type GraphiteParser struct {
+	separator   string
+	tags        map[string]string
+	defaultTmpl *graphiteTemplate
+	tmpls       []*graphiteTemplate
+}
+
+func NewGraphiteParser(separator string, templates []string, tags []string) (gp *GraphiteParser, err error) {
+	if separator == "" {
+		separator = "."
+	}
+	gp = &GraphiteParser{separator: separator}
+	if gp.tags, err = parseGraphiteTags(tags); err != nil {
+		return nil, err
+	}
+	gp.defaultTmpl, _ = newGraphiteTemplate(GraphiteDefaultTemplate)
+	for _, s := range templates {
+		tmpl, err := newGraphiteTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(tmpl.filter) == 0 {
+			gp.defaultTmpl = tmpl
+			continue
+		}
+		gp.tmpls = append(gp.tmpls, tmpl)
+	}
+	return
+}
+
+func (gp *GraphiteParser) template(elems []string) *graphiteTemplate {
+	var best *graphiteTemplate
+	for _, tmpl := range gp.tmpls {
+		if tmpl.match(elems) && (best == nil || tmpl.moreSpecific(best)) {
+			best = tmpl
+		}
+	}
+	if best == nil {
+		return gp.defaultTmpl
+	}
+	return best
+}
+
+// Parse converts the line: <path> <value> [timestamp] into the line protocol with ns precision,
+// the timestamp is in seconds and the current time is used if it is missing or -1,
+// the tagged path of graphite 1.1 like cpu.load;host=web01 is also supported
+func (gp *GraphiteParser) Parse(line string) ([]byte, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, ErrGraphiteInvalidLine
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid graphite value %q", fields[1])
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, ErrGraphiteInvalidValue
+	}
+	ts := time.Now().UnixNano()
+	if len(fields) == 3 && fields[2] != "-1" {
+		sec, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid graphite timestamp %q", fields[2])
+		}
+		ts = int64(sec * float64(time.Second))
+	}
+
+	segs := strings.Split(fields[0], ";")
+	if segs[0] == "" {
+		return nil, ErrGraphiteEmptyPath
+	}
+	elems := strings.Split(segs[0], ".")
+	tmpl := gp.template(elems)
+	measurement, parsed, field := tmpl.apply(gp.separator, elems)
+	if field == "" {
+		field = "value"
+	}
+	tags := make(map[string]string, len(gp.tags)+len(tmpl.tags)+len(parsed))
+	for _, m := range []map[string]string{gp.tags, tmpl.tags, parsed} {
+		for k, v := range m {
+			tags[k] = v
+		}
+	}
+	if len(segs) > 1 {
+		pathTags, err := parseGraphiteTags(segs[1:])
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range pathTags {
+			tags[k] = v
+		}
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	b.WriteString(util.EscapeMeasurement(measurement))
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(util.EscapeTag(k))
+		b.WriteByte('=')
+		b.WriteString(util.EscapeTag(tags[k]))
+	}
+	b.WriteByte(' ')
+	b.WriteString(util.EscapeTag(field))
+	b.WriteByte('=')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts, 10))
+	return b.Bytes(), nil
+}
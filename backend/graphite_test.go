@@ -0,0 +1,87 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestGraphiteParser(t *testing.T) {
+	gp, err := NewGraphiteParser("_", []string{
+		"servers.* .host.measurement* region=us",
+		"servers.*.cpu .host.measurement.field*",
+		"stats.* .measurement.field",
+		"measurement.measurement.host",
+	}, []string{"dc=lga"})
+	if err != nil {
+		t.Fatalf("new parser error: %s", err)
+	}
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "default",
+			line: "cpu.load.web01 0.5 1596819659",
+			want: "cpu_load,dc=lga,host=web01 value=0.5 1596819659000000000",
+		},
+		{
+			name: "filter",
+			line: "servers.web01.disk.used 42 1596819659",
+			want: "disk_used,dc=lga,host=web01,region=us value=42 1596819659000000000",
+		},
+		{
+			name: "more_specific",
+			line: "servers.web01.cpu.usage.idle 98.5 1596819659",
+			want: "cpu,dc=lga,host=web01 usage_idle=98.5 1596819659000000000",
+		},
+		{
+			name: "field",
+			line: "stats.requests.count 10 1596819659.5",
+			want: "requests,dc=lga count=10 1596819659500000000",
+		},
+		{
+			name: "tagged",
+			line: "stats.requests.count;dc=sjc;env=prod 10 1596819659",
+			want: "requests,dc=sjc,env=prod count=10 1596819659000000000",
+		},
+	}
+	for _, tt := range tests {
+		line, err := gp.Parse(tt.line)
+		if err != nil || string(line) != tt.want {
+			t.Errorf("%v: got %s %v, want %s", tt.name, line, err, tt.want)
+		}
+	}
+
+	invalids := []string{
+		"cpu.load",
+		"cpu.load abc 1596819659",
+		"cpu.load 1 now",
+		"cpu.load;host 1 1596819659",
+	}
+	for _, line := range invalids {
+		if _, err := gp.Parse(line); err == nil {
+			t.Errorf("%s: expect error", line)
+		}
+	}
+	if _, err := gp.Parse("cpu.load NaN 1596819659"); err != ErrGraphiteInvalidValue {
+		t.Errorf("expect ErrGraphiteInvalidValue, got %v", err)
+	}
+}
+
+func TestNewGraphiteParser(t *testing.T) {
+	invalids := [][]string{
+		{"host.field"},
+		{"measurement*.host"},
+		{"cpu.* measurement region"},
+		{"a b c d"},
+	}
+	for _, templates := range invalids {
+		if _, err := NewGraphiteParser(".", templates, nil); err == nil {
+			t.Errorf("%v: expect error", templates)
+		}
+	}
+}
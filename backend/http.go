@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/chengshiwen/influx-proxy/util"
+	jsoniter "github.com/json-iterator/go"
 )
 
 var (
@@ -38,23 +39,29 @@ type QueryResult struct {
 	Err    error
 }
 
+// basicAuth is the credentials of the backend, which can be reloaded
+type basicAuth struct {
+	username string
+	password string
+	encrypt  bool
+}
+
 type HttpBackend struct { // nolint:golint
-	client      *http.Client
-	transport   *http.Transport
-	Name        string
-	Url         string // nolint:golint
-	Username    string
-	Password    string
-	AuthEncrypt bool
-	interval    int
-	active      atomic.Value
-	rewriting   atomic.Value
-	writeOnly   atomic.Value
+	client    atomic.Value
+	transport *http.Transport
+	Name      string
+	Url       string // nolint:golint
+	auth      atomic.Value
+	codec     *Codec
+	interval  int
+	active    atomic.Value
+	rewriting atomic.Value
+	writeOnly atomic.Value
 }
 
 func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend) { // nolint:golint
 	hb = NewSimpleHttpBackend(cfg)
-	hb.client = NewClient(strings.HasPrefix(cfg.Url, "https"), pxcfg.WriteTimeout)
+	hb.client.Store(NewClient(strings.HasPrefix(cfg.Url, "https"), pxcfg.WriteTimeout))
 	hb.interval = pxcfg.CheckInterval
 	go hb.CheckActive()
 	return
@@ -62,12 +69,15 @@ func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend) {
 
 func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend) { // nolint:golint
 	hb = &HttpBackend{
-		transport:   NewTransport(strings.HasPrefix(cfg.Url, "https")),
-		Name:        cfg.Name,
-		Url:         cfg.Url,
-		Username:    cfg.Username,
-		Password:    cfg.Password,
-		AuthEncrypt: cfg.AuthEncrypt,
+		transport: NewTransport(strings.HasPrefix(cfg.Url, "https")),
+		Name:      cfg.Name,
+		Url:       cfg.Url,
+	}
+	hb.SetAuth(cfg.Username, cfg.Password, cfg.AuthEncrypt)
+	// the compression has been checked by checkConfig
+	hb.codec, _ = NewCodec(cfg.Compression, cfg.CompressionLevel)
+	if hb.codec == nil {
+		hb.codec, _ = NewCodec(CodecGzip, 0)
 	}
 	hb.active.Store(true)
 	hb.rewriting.Store(false)
@@ -114,20 +124,6 @@ func CloneQueryRequest(r *http.Request) *http.Request {
 	return cr
 }
 
-func Compress(buf *bytes.Buffer, p []byte) (err error) {
-	zip := gzip.NewWriter(buf)
-	n, err := zip.Write(p)
-	if err != nil {
-		return
-	}
-	if n != len(p) {
-		err = io.ErrShortWrite
-		return
-	}
-	err = zip.Close()
-	return
-}
-
 func CopyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -144,8 +140,29 @@ func SetBasicAuth(req *http.Request, username string, password string, authEncry
 	}
 }
 
+// SetBasicAuth sets the credentials of the backend to the request if not empty
 func (hb *HttpBackend) SetBasicAuth(req *http.Request) {
-	SetBasicAuth(req, hb.Username, hb.Password, hb.AuthEncrypt)
+	auth := hb.auth.Load().(*basicAuth)
+	if auth.username != "" || auth.password != "" {
+		SetBasicAuth(req, auth.username, auth.password, auth.encrypt)
+	}
+}
+
+// SetAuth replaces the credentials of the backend
+func (hb *HttpBackend) SetAuth(username, password string, encrypt bool) {
+	hb.auth.Store(&basicAuth{username: username, password: password, encrypt: encrypt})
+}
+
+// SetWriteTimeout replaces the client with a new timeout, which shares the connections of the former
+func (hb *HttpBackend) SetWriteTimeout(timeout int) {
+	if client := hb.getClient(); client != nil {
+		hb.client.Store(&http.Client{Transport: client.Transport, Timeout: time.Duration(timeout) * time.Second})
+	}
+}
+
+func (hb *HttpBackend) getClient() *http.Client {
+	client, _ := hb.client.Load().(*http.Client)
+	return client
 }
 
 func (hb *HttpBackend) CheckActive() {
@@ -176,7 +193,7 @@ func (hb *HttpBackend) SetWriteOnly(b bool) {
 }
 
 func (hb *HttpBackend) Ping() bool {
-	resp, err := hb.client.Get(hb.Url + "/ping")
+	resp, err := hb.getClient().Get(hb.Url + "/ping")
 	if err != nil {
 		log.Print("http error: ", err)
 		return false
@@ -189,34 +206,33 @@ func (hb *HttpBackend) Ping() bool {
 	return true
 }
 
-func (hb *HttpBackend) Write(db, rp string, p []byte) (err error) {
-	var buf bytes.Buffer
-	err = Compress(&buf, p)
+// Write encodes the data by the compression of the backend and writes it
+func (hb *HttpBackend) Write(db, rp, precision string, p []byte) (err error) {
+	p, err = hb.codec.Encode(p)
 	if err != nil {
-		log.Print("compress error: ", err)
+		log.Printf("compress %s error: %s", hb.codec.Name, err)
 		return
 	}
-	return hb.WriteStream(db, rp, &buf, true)
+	return hb.WriteEncoded(db, rp, precision, p)
 }
 
-func (hb *HttpBackend) WriteCompressed(db, rp string, p []byte) (err error) {
-	buf := bytes.NewBuffer(p)
-	return hb.WriteStream(db, rp, buf, true)
+// WriteEncoded writes the data encoded by the compression of the backend
+func (hb *HttpBackend) WriteEncoded(db, rp, precision string, p []byte) (err error) {
+	return hb.WriteStream(db, rp, precision, bytes.NewReader(p), hb.codec.ContentEncoding())
 }
 
-func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed bool) (err error) {
+func (hb *HttpBackend) WriteStream(db, rp, precision string, stream io.Reader, encoding string) (err error) {
 	q := url.Values{}
 	q.Set("db", db)
 	q.Set("rp", rp)
+	q.Set("precision", precision)
 	req, err := http.NewRequest("POST", hb.Url+"/write?"+q.Encode(), stream)
-	if hb.Username != "" || hb.Password != "" {
-		hb.SetBasicAuth(req)
-	}
-	if compressed {
-		req.Header.Add("Content-Encoding", "gzip")
+	hb.SetBasicAuth(req)
+	if encoding != "" {
+		req.Header.Add("Content-Encoding", encoding)
 	}
 
-	resp, err := hb.client.Do(req)
+	resp, err := hb.getClient().Do(req)
 	if err != nil {
 		log.Print("http error: ", err)
 		hb.active.Store(false)
@@ -262,9 +278,7 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 	req.Form.Del("u")
 	req.Form.Del("p")
 	req.ContentLength = 0
-	if hb.Username != "" || hb.Password != "" {
-		hb.SetBasicAuth(req)
-	}
+	hb.SetBasicAuth(req)
 
 	req.URL, qr.Err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
 	if qr.Err != nil {
@@ -312,6 +326,56 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 	return
 }
 
+// QueryFlux forwards the flux query to the /api/v2/query endpoint, which requires flux-enabled in InfluxDB 1.8+
+func (hb *HttpBackend) QueryFlux(req *http.Request, w http.ResponseWriter, body []byte) (qr *QueryResult) {
+	qr = &QueryResult{}
+	freq, err := http.NewRequestWithContext(req.Context(), "POST", hb.Url+"/api/v2/query", bytes.NewReader(body))
+	if err != nil {
+		qr.Err = err
+		return
+	}
+	freq.Header.Set("Content-Type", req.Header.Get("Content-Type"))
+	if accept := req.Header.Get("Accept"); accept != "" {
+		freq.Header.Set("Accept", accept)
+	}
+	hb.SetBasicAuth(freq)
+
+	// the transport requests and decompresses gzip transparently
+	resp, err := hb.transport.RoundTrip(freq)
+	if err != nil {
+		qr.Err = err
+		log.Printf("flux query error: %s, the backend is %s", err, hb.Url)
+		return
+	}
+	defer resp.Body.Close()
+	if w != nil {
+		CopyHeader(w.Header(), resp.Header)
+	}
+
+	qr.Body, qr.Err = ioutil.ReadAll(resp.Body)
+	if qr.Err != nil {
+		log.Printf("read body error: %s, the backend is %s", qr.Err, hb.Url)
+		return
+	}
+	if resp.StatusCode >= 400 {
+		var rsp struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		jsoniter.Unmarshal(qr.Body, &rsp)
+		if rsp.Message != "" {
+			qr.Err = errors.New(rsp.Message)
+		} else if rsp.Error != "" {
+			qr.Err = errors.New(rsp.Error)
+		} else {
+			qr.Err = fmt.Errorf("flux query status code: %d", resp.StatusCode)
+		}
+	}
+	qr.Header = resp.Header
+	qr.Status = resp.StatusCode
+	return
+}
+
 func (hb *HttpBackend) QueryIQL(method, db, q, epoch string) ([]byte, error) {
 	qr := hb.Query(NewQueryRequest(method, db, q, epoch), nil, true)
 	return qr.Body, qr.Err
@@ -365,6 +429,16 @@ func (hb *HttpBackend) GetFieldKeys(db, meas string) map[string][]string {
 	return fieldKeys
 }
 
+func (hb *HttpBackend) GetSeries(db, meas string) []string {
+	return hb.GetSeriesValues(db, fmt.Sprintf("show series from \"%s\"", util.EscapeIdentifier(meas)))
+}
+
+func (hb *HttpBackend) DropSeries(db, meas, where string) ([]byte, error) {
+	q := fmt.Sprintf("drop series from \"%s\" where %s", util.EscapeIdentifier(meas), where)
+	qr := hb.Query(NewQueryRequest("POST", db, q, ""), nil, true)
+	return qr.Body, qr.Err
+}
+
 func (hb *HttpBackend) DropMeasurement(db, meas string) ([]byte, error) {
 	q := fmt.Sprintf("drop measurement \"%s\"", util.EscapeIdentifier(meas))
 	qr := hb.Query(NewQueryRequest("POST", db, q, ""), nil, true)
@@ -0,0 +1,166 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var (
+	ErrJSONMissingMeasurement = errors.New("json point missing measurement")
+	ErrJSONMissingFields      = errors.New("json point missing fields")
+	ErrJSONInvalidTime        = errors.New("json point has an invalid time, require an integer or a RFC3339 string")
+	ErrJSONNewline            = errors.New("json point cannot contain newline")
+)
+
+// JSONPoint is a point of the json write body
+type JSONPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        interface{}            `json:"time"`
+}
+
+// ParseJSONPoints parses the json write body, which is a single point or an array of points
+func ParseJSONPoints(body []byte) (pts []*JSONPoint, err error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = dec.Decode(&pts)
+		return
+	}
+	pt := &JSONPoint{}
+	if err = dec.Decode(pt); err != nil {
+		return
+	}
+	return []*JSONPoint{pt}, nil
+}
+
+// Line converts the point into the escaped line protocol with the precision,
+// the numbers are float fields, and the time is an integer in the precision or a RFC3339 string
+func (pt *JSONPoint) Line(precision string) ([]byte, error) {
+	if pt.Measurement == "" {
+		return nil, ErrJSONMissingMeasurement
+	}
+	if len(pt.Fields) == 0 {
+		return nil, ErrJSONMissingFields
+	}
+	var b strings.Builder
+	b.WriteString(util.EscapeMeasurement(pt.Measurement))
+
+	keys := make([]string, 0, len(pt.Tags))
+	for k, v := range pt.Tags {
+		if k == "" {
+			return nil, fmt.Errorf("json point has an empty tag key")
+		}
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(util.EscapeTag(k))
+		b.WriteByte('=')
+		b.WriteString(util.EscapeTag(pt.Tags[k]))
+	}
+
+	keys = keys[:0]
+	for k := range pt.Fields {
+		if k == "" {
+			return nil, fmt.Errorf("json point has an empty field key")
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(util.EscapeTag(k))
+		b.WriteByte('=')
+		switch v := pt.Fields[k].(type) {
+		case json.Number:
+			// the number without a fraction or exponent is an integer, such as 10 rather than 10.0
+			if !strings.ContainsAny(string(v), ".eE") {
+				n, err := v.Int64()
+				if err != nil {
+					return nil, fmt.Errorf("json point has an invalid integer field %q", k)
+				}
+				b.WriteString(strconv.FormatInt(n, 10))
+				b.WriteByte('i')
+				break
+			}
+			f, err := v.Float64()
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, fmt.Errorf("json point has an invalid number field %q", k)
+			}
+			b.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
+		case string:
+			b.WriteByte('"')
+			b.WriteString(util.EscapeStringField(v))
+			b.WriteByte('"')
+		case bool:
+			b.WriteString(strconv.FormatBool(v))
+		default:
+			return nil, fmt.Errorf("json point has an unsupported field %q, require number, string or bool", k)
+		}
+	}
+
+	switch v := pt.Time.(type) {
+	case nil:
+	case json.Number:
+		ts, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return nil, ErrJSONInvalidTime
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(ts, 10))
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, ErrJSONInvalidTime
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(t.UnixNano()/models.GetPrecisionMultiplier(precision), 10))
+	default:
+		return nil, ErrJSONInvalidTime
+	}
+
+	line := b.String()
+	if strings.IndexByte(line, '\n') >= 0 {
+		return nil, ErrJSONNewline
+	}
+	return []byte(line), nil
+}
+
+// WriteJSON writes the json points in the same way as Write
+func (ip *Proxy) WriteJSON(pts []*JSONPoint, db, rp, precision string, wt *WriteTracker) error {
+	var wr writeResult
+	for i, pt := range pts {
+		line, err := pt.Line(precision)
+		if err != nil {
+			wr.add([]byte(pt.Measurement), i+1, err)
+			continue
+		}
+		wr.add(line, i+1, ip.writeRow(line, db, rp, precision, wt))
+	}
+	ip.SyncWAL()
+	return wr.err()
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestJSONPointLine(t *testing.T) {
+	body := `[
+		{"measurement": "cpu load", "tags": {"host": "web,01", "region": "us=west", "empty": ""},
+			"fields": {"value": 0.64, "msg": "say \"hi\"\\n", "ok": true}, "time": 1596819659},
+		{"measurement": "mem", "fields": {"used": 10, "free": -2, "ratio": 10.0, "total": 1e3}, "time": "2020-08-07T17:00:59.5Z"},
+		{"measurement": "disk", "fields": {"free": 1}},
+		{"measurement": "", "fields": {"value": 1}},
+		{"measurement": "cpu", "fields": {}},
+		{"measurement": "cpu", "fields": {"value": [1]}},
+		{"measurement": "cpu", "fields": {"value": 1}, "time": "yesterday"},
+		{"measurement": "cpu\nmem", "fields": {"value": 1}},
+		{"measurement": "cpu", "fields": {"value": 9223372036854775808}}
+	]`
+	pts, err := ParseJSONPoints([]byte(body))
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	want := []string{
+		`cpu\ load,host=web\,01,region=us\=west msg="say \"hi\"\\n",ok=true,value=0.64 1596819659`,
+		`mem free=-2i,ratio=10,total=1000,used=10i 1596819659`,
+		`disk free=1i`,
+	}
+	for i, pt := range pts {
+		line, err := pt.Line("s")
+		if i < len(want) {
+			if err != nil || string(line) != want[i] {
+				t.Errorf("point %d: got %s %v, want %s", i, line, err, want[i])
+			}
+		} else if err == nil {
+			t.Errorf("point %d: expect error, got %s", i, line)
+		}
+	}
+
+	pts, err = ParseJSONPoints([]byte(` {"measurement": "cpu", "fields": {"value": 1}, "time": 1596819659000000000}`))
+	if err != nil || len(pts) != 1 {
+		t.Fatalf("got %v %v", pts, err)
+	}
+	if line, err := pts[0].Line("ns"); err != nil || string(line) != "cpu value=1i 1596819659000000000" {
+		t.Errorf("got %s %v", line, err)
+	}
+	if _, err = ParseJSONPoints([]byte(`[{"measurement": "cpu"`)); err == nil {
+		t.Error("expect error")
+	}
+}
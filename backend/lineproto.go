@@ -6,6 +6,8 @@ package backend
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
@@ -14,10 +16,63 @@ import (
 	"github.com/influxdata/influxdb1-client/models"
 )
 
+// MaxParseErrors is the max number of parse errors reported in a partial write error
+var MaxParseErrors = 10
+
+var (
+	ErrMissingFields   = errors.New("missing fields")
+	ErrInvalidFormat   = errors.New("invalid format")
+	ErrLineTooLong     = errors.New("line too long")
+	ErrMissingTagValue = errors.New("missing tag value")
+)
+
+type ParseError struct {
+	Line   []byte
+	Lineno int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("unable to parse '%s' at line %d: %s", e.Line, e.Lineno, e.Err)
+}
+
+// PartialWriteError is compatible with the partial write error of InfluxDB
+type PartialWriteError struct {
+	Errors  []*ParseError
+	Dropped int
+}
+
+func (e *PartialWriteError) Add(line []byte, lineno int, err error) {
+	e.Dropped++
+	if len(e.Errors) < MaxParseErrors {
+		e.Errors = append(e.Errors, &ParseError{Line: bytes.TrimSpace(line), Lineno: lineno, Err: err})
+	}
+}
+
+func (e *PartialWriteError) Error() string {
+	reasons := make([]string, len(e.Errors))
+	for i, pe := range e.Errors {
+		reasons[i] = pe.Error()
+	}
+	if e.Dropped > len(e.Errors) {
+		reasons = append(reasons, fmt.Sprintf("and %d more errors", e.Dropped-len(e.Errors)))
+	}
+	return fmt.Sprintf("partial write: %s dropped=%d", strings.Join(reasons, "\n"), e.Dropped)
+}
+
 type LinePoint struct {
-	Db   string
-	Rp   string
-	Line []byte
+	Db        string
+	Rp        string
+	Precision string
+	Line      []byte
+	Ack       *WriteAck
+	seg       *walSegment
+}
+
+// IsSkipLine reports whether the line is a blank line or a comment line
+func IsSkipLine(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) == 0 || line[0] == '#'
 }
 
 func ScanKey(pointbuf []byte) (key string, err error) {
@@ -50,26 +105,15 @@ func ScanTime(buf []byte) (int, bool) {
 	return i, i > 0 && i < len(buf)-1 && (buf[i] == ' ' || buf[i] == 0)
 }
 
-func AppendNano(line []byte, precision string) []byte {
+// AppendTime appends the current time in the precision when the line has no timestamp,
+// the timestamp of the line is kept as it is and forwarded with the precision
+func AppendTime(line []byte, precision string) []byte {
 	line = bytes.TrimSpace(line)
-	pos, found := ScanTime(line)
-	if found {
-		if precision == "ns" || precision == "n" {
-			return line
-		} else if precision == "u" {
-			return append(line, '0', '0', '0')
-		} else if precision == "ms" {
-			return append(line, '0', '0', '0', '0', '0', '0')
-		} else if precision == "s" {
-			return append(line, '0', '0', '0', '0', '0', '0', '0', '0', '0')
-		} else {
-			mul := models.GetPrecisionMultiplier(precision)
-			nano := BytesToInt64(line[pos+1:]) * mul
-			return append(line[:pos+1], Int64ToBytes(nano)...)
-		}
-	} else {
-		return append(line, []byte(" "+strconv.FormatInt(time.Now().UnixNano(), 10))...)
+	if _, found := ScanTime(line); found {
+		return line
 	}
+	ts := time.Now().UnixNano() / models.GetPrecisionMultiplier(precision)
+	return append(line, []byte(" "+strconv.FormatInt(ts, 10))...)
 }
 
 func Int64ToBytes(n int64) []byte {
@@ -118,3 +162,17 @@ Loop:
 	}
 	return j-i > 3
 }
+
+// StrictCheck fully parses the line with the timestamp in the precision by the line protocol parser of InfluxDB
+func StrictCheck(line []byte, precision string) error {
+	points, err := models.ParsePointsWithPrecision(line, time.Time{}, precision)
+	if err != nil {
+		// the parser has wrapped the error with the line, just keep the reason
+		msg := strings.TrimPrefix(err.Error(), fmt.Sprintf("unable to parse '%s': ", line))
+		return errors.New(msg)
+	}
+	if len(points) != 1 {
+		return ErrInvalidFormat
+	}
+	return nil
+}
@@ -8,8 +8,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
 )
 
 func TestScanKey(t *testing.T) {
@@ -99,7 +103,7 @@ func BenchmarkScanKey(b *testing.B) {
 	}
 }
 
-func TestAppendNano(t *testing.T) {
+func TestAppendTime(t *testing.T) {
 	tests := []struct {
 		name string
 		line []byte
@@ -111,111 +115,109 @@ func TestAppendNano(t *testing.T) {
 			name: "test1",
 			line: []byte("cpu1 value=1,value2=2"),
 			time: false,
-			unit: "",
+			unit: "n",
 			want: "cpu1 value=1,value2=2",
 		},
 		{
 			name: "test2",
 			line: []byte(" cpu1 value=3,value2=4 1422568543702900257 "),
 			time: true,
-			unit: "",
+			unit: "n",
 			want: "cpu1 value=3,value2=4 1422568543702900257",
 		},
 		{
 			name: "test3",
-			line: []byte("  cpu2 value=1,value2=2 "),
+			line: []byte("\tcpu2 value=1,value2=2\t"),
 			time: false,
-			unit: "s",
+			unit: "u",
 			want: "cpu2 value=1,value2=2",
 		},
 		{
 			name: "test4",
-			line: []byte("cpu2 value=3,value2=4 1596819659"),
+			line: []byte("\tcpu2 value=3,value2=4 1434055562000010\t"),
 			time: true,
-			unit: "s",
-			want: "cpu2 value=3,value2=4 1596819659000000000",
+			unit: "u",
+			want: "cpu2 value=3,value2=4 1434055562000010",
 		},
 		{
 			name: "test5",
-			line: []byte("cpu3 value=1,value2=2"),
+			line: []byte("  cpu3 value=1,value2=2  "),
 			time: false,
-			unit: "h",
+			unit: "ms",
 			want: "cpu3 value=1,value2=2",
 		},
 		{
 			name: "test6",
-			line: []byte(" cpu3 value=3,value2=4  439888  "),
+			line: []byte("cpu3 value=3,value2=4  1596819420440"),
 			time: true,
-			unit: "h",
-			want: "cpu3 value=3,value2=4  1583596800000000000",
+			unit: "ms",
+			want: "cpu3 value=3,value2=4  1596819420440",
 		},
 		{
 			name: "test7",
-			line: []byte("  cpu4 value=1,value2=2  "),
+			line: []byte("  cpu4 value=1,value2=2 "),
 			time: false,
-			unit: "ms",
+			unit: "s",
 			want: "cpu4 value=1,value2=2",
 		},
 		{
 			name: "test8",
-			line: []byte("cpu4 value=3,value2=4  1596819420440"),
+			line: []byte(" cpu4 value=3,value2=4 1596819659 "),
 			time: true,
-			unit: "ms",
-			want: "cpu4 value=3,value2=4  1596819420440000000",
+			unit: "s",
+			want: "cpu4 value=3,value2=4 1596819659",
 		},
 		{
 			name: "test9",
-			line: []byte("\tcpu5 value=3,value2=4\t"),
+			line: []byte("cpu5 value=1,value2=2\r\n"),
 			time: false,
-			unit: "u",
-			want: "cpu5 value=3,value2=4",
+			unit: "m",
+			want: "cpu5 value=1,value2=2",
 		},
 		{
 			name: "test10",
-			line: []byte("\tcpu5 value=3,value2=4 1434055562000010\t"),
+			line: []byte("cpu5 value=3,value2=4 26613661\r\n"),
 			time: true,
-			unit: "u",
-			want: "cpu5 value=3,value2=4 1434055562000010000",
+			unit: "m",
+			want: "cpu5 value=3,value2=4 26613661",
 		},
 		{
 			name: "test11",
-			line: []byte(" \tcpu6 value=1,value2=2 \t"),
+			line: []byte("cpu6 value=1,value2=2"),
 			time: false,
-			unit: "ns",
+			unit: "h",
 			want: "cpu6 value=1,value2=2",
 		},
 		{
 			name: "test12",
-			line: []byte(" \tcpu6 value=3,value2=4 1434055562000010000 \t"),
-			time: true,
-			unit: "ns",
-			want: "cpu6 value=3,value2=4 1434055562000010000",
-		},
-		{
-			name: "test13",
-			line: []byte("cpu6 value=5,value2=6 1434055562000010000"),
+			line: []byte(" cpu6 value=3,value2=4  439888  "),
 			time: true,
-			unit: "n",
-			want: "cpu6 value=5,value2=6 1434055562000010000",
+			unit: "h",
+			want: "cpu6 value=3,value2=4  439888",
 		},
 	}
 	for _, tt := range tests {
-		got := AppendNano(tt.line, tt.unit)
+		got := AppendTime(tt.line, tt.unit)
 		if tt.time {
 			if string(got) != tt.want {
-				t.Errorf("%v: got %v, want %v", tt.name, string(got), tt.want)
-				continue
-			}
-		} else {
-			if strings.Index(string(got), tt.want) != 0 || len(string(got)) != len(tt.want)+20 {
-				t.Errorf("%v: got %v, want %v", tt.name, string(got), tt.want)
-				continue
+				t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
 			}
+			continue
+		}
+		// the current time in the precision is appended to the line without a timestamp
+		if !bytes.HasPrefix(got, []byte(tt.want+" ")) {
+			t.Errorf("%v: got %s, want prefix %s", tt.name, got, tt.want)
+			continue
+		}
+		ts, err := strconv.ParseInt(string(got[len(tt.want)+1:]), 10, 64)
+		now := time.Now().UnixNano() / models.GetPrecisionMultiplier(tt.unit)
+		if err != nil || now-ts < 0 || now-ts > int64(time.Second)/models.GetPrecisionMultiplier(tt.unit)+1 {
+			t.Errorf("%v: got %s, want the current time in %s", tt.name, got, tt.unit)
 		}
 	}
 }
 
-func BenchmarkAppendNano(b *testing.B) {
+func BenchmarkAppendTime(b *testing.B) {
 	buf := &bytes.Buffer{}
 	for i := 0; i < b.N; i++ {
 		fmt.Fprintf(buf, "%s%d,a=%d,b=2 c=3 1596819659\n", "name", i, i)
@@ -238,7 +240,7 @@ func BenchmarkAppendNano(b *testing.B) {
 		}
 
 		line = bytes.TrimRight(line, " \t\r\n")
-		AppendNano(line, "s")
+		AppendTime(line, "s")
 	}
 }
 
@@ -374,3 +376,85 @@ func BenchmarkRapidCheck(b *testing.B) {
 		RapidCheck(line)
 	}
 }
+
+func TestPartialWriteError(t *testing.T) {
+	pwe := &PartialWriteError{}
+	pwe.Add([]byte("cpu\n"), 2, ErrMissingFields)
+	pwe.Add([]byte(" cpu value 1 \n"), 5, ErrInvalidFormat)
+	want := "partial write: unable to parse 'cpu' at line 2: missing fields\nunable to parse 'cpu value 1' at line 5: invalid format dropped=2"
+	if got := pwe.Error(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for i := 0; i < MaxParseErrors; i++ {
+		pwe.Add([]byte("cpu"), 10+i, ErrMissingFields)
+	}
+	if len(pwe.Errors) != MaxParseErrors || pwe.Dropped != MaxParseErrors+2 || !strings.Contains(pwe.Error(), "and 2 more errors dropped=12") {
+		t.Errorf("got %q, errors %d, dropped %d", pwe.Error(), len(pwe.Errors), pwe.Dropped)
+	}
+}
+
+func TestIsSkipLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"", true},
+		{"  \r\n", true},
+		{"# comment", true},
+		{"cpu value=1", false},
+	}
+	for _, tt := range tests {
+		if got := IsSkipLine([]byte(tt.line)); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestStrictCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "valid",
+			line: "cpu,host=server01 value=0.67,id=2i,running=true,status=\"ok\" 1596819659000000000",
+			want: "",
+		},
+		{
+			name: "escaped",
+			line: "cpu3,host=server05,region=cn\\ north idle=64,user=\"Dwayne \\\"Johnson\\\"\" 1596819659000000000",
+			want: "",
+		},
+		{
+			name: "bad_field_value",
+			line: "cpu value=abc 1596819659000000000",
+			want: "invalid boolean",
+		},
+		{
+			name: "unescaped_quote",
+			line: "cpu value=\"ok 1596819659000000000",
+			want: "unbalanced quotes",
+		},
+		{
+			name: "duplicate_tags",
+			line: "cpu,host=a,host=b value=1 1596819659000000000",
+			want: "duplicate tags",
+		},
+		{
+			name: "missing_fields",
+			line: "cpu,host=a 1596819659000000000",
+			want: "invalid field format",
+		},
+	}
+	for _, tt := range tests {
+		err := StrictCheck([]byte(tt.line), "n")
+		if (tt.want == "" && err != nil) || (tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want))) {
+			t.Errorf("%v: got %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err != nil && strings.Contains(err.Error(), "unable to parse") {
+			t.Errorf("%v: got %v, the line should be stripped", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// LineListener is a udp or tcp listener of the line protocol bound to a db, rp and precision
+type LineListener struct {
+	packets         int64 // keep first for 64-bit alignment of atomic operations
+	points          int64
+	failures        int64
+	Protocol        string
+	BindAddr        string
+	Database        string
+	RetentionPolicy string
+	Precision       string
+	ReadBuffer      int
+}
+
+type LineListenerStats struct {
+	Protocol      string `json:"protocol"`
+	BindAddr      string `json:"bind_addr"`
+	Database      string `json:"database"`
+	Packets       int64  `json:"packets"`
+	Points        int64  `json:"points"`
+	ParseFailures int64  `json:"parse_failures"`
+}
+
+func NewLineListener(cfg *LineProtocolConfig) *LineListener {
+	return &LineListener{
+		Protocol:        cfg.Protocol,
+		BindAddr:        cfg.BindAddr,
+		Database:        cfg.Database,
+		RetentionPolicy: cfg.RetentionPolicy,
+		Precision:       cfg.Precision,
+		ReadBuffer:      cfg.ReadBuffer,
+	}
+}
+
+func (ll *LineListener) Stats() *LineListenerStats {
+	return &LineListenerStats{
+		Protocol:      ll.Protocol,
+		BindAddr:      ll.BindAddr,
+		Database:      ll.Database,
+		Packets:       atomic.LoadInt64(&ll.packets),
+		Points:        atomic.LoadInt64(&ll.points),
+		ParseFailures: atomic.LoadInt64(&ll.failures),
+	}
+}
+
+// WriteListener writes a udp packet or a tcp line received by the listener in the same way as Write,
+// except that the wal is synced by the caller once for a batch of packets or lines
+func (ip *Proxy) WriteListener(ll *LineListener, p []byte) error {
+	atomic.AddInt64(&ll.packets, 1)
+	n, err := ip.write(bytes.NewReader(p), ll.Database, ll.RetentionPolicy, ll.Precision, nil)
+	atomic.AddInt64(&ll.points, int64(n))
+	if pwe, ok := err.(*PartialWriteError); ok {
+		atomic.AddInt64(&ll.failures, int64(pwe.Dropped))
+	}
+	return err
+}
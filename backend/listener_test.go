@@ -0,0 +1,23 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestWriteListener(t *testing.T) {
+	ip := &Proxy{ShardRules: NewShardRules(nil), WriteValidation: "rapid"}
+	ll := NewLineListener(&LineProtocolConfig{Protocol: "udp", BindAddr: ":8089", Database: "db1", Precision: "s"})
+	ip.WriteListener(ll, []byte("cpu,host=server01 value=1 1596819659\n# comment\nmem value=2 1596819659\n"))
+	err := ip.WriteListener(ll, []byte("cpu value=1\ncpu,host=server01\n"))
+	if pwe, ok := err.(*PartialWriteError); !ok || pwe.Dropped != 1 {
+		t.Errorf("expect partial write error, got %v", err)
+	}
+	stats := ll.Stats()
+	if stats.Packets != 2 || stats.Points != 3 || stats.ParseFailures != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+var (
+	ErrOpenTSDBInvalidPut    = errors.New("invalid opentsdb put, require put <metric> <timestamp> <value> <tagk=tagv> ...")
+	ErrOpenTSDBMissingMetric = errors.New("opentsdb data point missing metric")
+	ErrOpenTSDBInvalidValue  = errors.New("opentsdb data point has an invalid value")
+)
+
+// OpenTSDBPoint is a data point of the telnet put command or the /api/put json
+type OpenTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// ParseOpenTSDBPut parses the telnet command: put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+func ParseOpenTSDBPut(line string) (*OpenTSDBPoint, error) {
+	parts := strings.Fields(line)
+	if len(parts) < 4 || parts[0] != "put" {
+		return nil, ErrOpenTSDBInvalidPut
+	}
+	ts, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid opentsdb timestamp %q", parts[2])
+	}
+	pt := &OpenTSDBPoint{Metric: parts[1], Timestamp: ts, Value: json.Number(parts[3]), Tags: make(map[string]string)}
+	for _, tag := range parts[4:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid opentsdb tag %q", tag)
+		}
+		pt.Tags[kv[0]] = kv[1]
+	}
+	return pt, nil
+}
+
+// ParseOpenTSDBJSON parses the body of /api/put, which is a single data point or an array of data points
+func ParseOpenTSDBJSON(body []byte) (pts []*OpenTSDBPoint, err error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &pts)
+		return
+	}
+	pt := &OpenTSDBPoint{}
+	if err = json.Unmarshal(body, pt); err != nil {
+		return
+	}
+	return []*OpenTSDBPoint{pt}, nil
+}
+
+// Line converts the data point into the line protocol with ns precision,
+// the timestamp is in milliseconds if it has more than 10 digits, otherwise in seconds
+func (pt *OpenTSDBPoint) Line() ([]byte, error) {
+	if pt.Metric == "" {
+		return nil, ErrOpenTSDBMissingMetric
+	}
+	value, err := strconv.ParseFloat(pt.Value.String(), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		// the line protocol has no representation of NaN or Inf
+		return nil, ErrOpenTSDBInvalidValue
+	}
+	ts := pt.Timestamp
+	if ts > 9999999999 {
+		ts *= int64(time.Millisecond)
+	} else {
+		ts *= int64(time.Second)
+	}
+
+	keys := make([]string, 0, len(pt.Tags))
+	for k, v := range pt.Tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	b.WriteString(util.EscapeMeasurement(pt.Metric))
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(util.EscapeTag(k))
+		b.WriteByte('=')
+		b.WriteString(util.EscapeTag(pt.Tags[k]))
+	}
+	b.WriteString(" value=")
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts, 10))
+	return b.Bytes(), nil
+}
+
+// WriteOpenTSDB writes the data points with ns precision
+func (ip *Proxy) WriteOpenTSDB(pts []*OpenTSDBPoint, db, rp string) error {
+	var wr writeResult
+	for i, pt := range pts {
+		line, err := pt.Line()
+		if err != nil {
+			wr.add([]byte(pt.Metric), i+1, err)
+			continue
+		}
+		wr.add(line, i+1, ip.WriteRow(line, db, rp, "ns"))
+	}
+	ip.SyncWAL()
+	return wr.err()
+}
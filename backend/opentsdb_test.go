@@ -0,0 +1,98 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestParseOpenTSDBPut(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "seconds",
+			line: "put sys.cpu.user 1596819659 42.5 host=web01 cpu=0",
+			want: "sys.cpu.user,cpu=0,host=web01 value=42.5 1596819659000000000",
+		},
+		{
+			name: "milliseconds",
+			line: "put sys.cpu.user 1596819659123 42 host=web,01",
+			want: "sys.cpu.user,host=web\\,01 value=42 1596819659123000000",
+		},
+		{
+			name: "no_tags",
+			line: "put mem  1596819659  1e3",
+			want: "mem value=1000 1596819659000000000",
+		},
+	}
+	for _, tt := range tests {
+		pt, err := ParseOpenTSDBPut(tt.line)
+		if err != nil {
+			t.Errorf("%v: error: %s", tt.name, err)
+			continue
+		}
+		line, err := pt.Line()
+		if err != nil || string(line) != tt.want {
+			t.Errorf("%v: got %s %v, want %s", tt.name, line, err, tt.want)
+		}
+	}
+
+	invalids := []string{
+		"put sys.cpu.user 1596819659",
+		"get sys.cpu.user 1596819659 42",
+		"put sys.cpu.user now 42",
+		"put sys.cpu.user 1596819659 42 host",
+	}
+	for _, line := range invalids {
+		if _, err := ParseOpenTSDBPut(line); err == nil {
+			t.Errorf("%s: expect error", line)
+		}
+	}
+	for _, value := range []string{"abc", "NaN", "+Inf", "-Inf"} {
+		pt, _ := ParseOpenTSDBPut("put sys.cpu.user 1596819659 " + value)
+		if _, err := pt.Line(); err != ErrOpenTSDBInvalidValue {
+			t.Errorf("%s: expect ErrOpenTSDBInvalidValue, got %v", value, err)
+		}
+	}
+}
+
+func TestParseOpenTSDBJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{
+			name: "single",
+			body: `{"metric": "sys.cpu.nice", "timestamp": 1596819659, "value": 18, "tags": {"host": "web01", "dc": "lga"}}`,
+			want: []string{"sys.cpu.nice,dc=lga,host=web01 value=18 1596819659000000000"},
+		},
+		{
+			name: "array",
+			body: `[{"metric": "sys.cpu.nice", "timestamp": 1596819659000, "value": "9.5", "tags": {"host": "web01"}},
+				{"metric": "sys.cpu.nice", "timestamp": 1596819660, "value": -1, "tags": {}}]`,
+			want: []string{"sys.cpu.nice,host=web01 value=9.5 1596819659000000000", "sys.cpu.nice value=-1 1596819660000000000"},
+		},
+	}
+	for _, tt := range tests {
+		pts, err := ParseOpenTSDBJSON([]byte(tt.body))
+		if err != nil || len(pts) != len(tt.want) {
+			t.Errorf("%v: got %d points, error: %v", tt.name, len(pts), err)
+			continue
+		}
+		for i, pt := range pts {
+			line, err := pt.Line()
+			if err != nil || string(line) != tt.want[i] {
+				t.Errorf("%v: got %s %v, want %s", tt.name, line, err, tt.want[i])
+			}
+		}
+	}
+	if _, err := ParseOpenTSDBJSON([]byte(`{"metric": 1}`)); err == nil {
+		t.Error("expect error")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/otlppb"
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const (
+	OTLPScopeNameTag    = "otel.scope.name"
+	OTLPScopeVersionTag = "otel.scope.version"
+)
+
+var (
+	ErrOTLPMissingName = errors.New("otlp metric missing name")
+	ErrOTLPNoFields    = errors.New("otlp data point has no valid value")
+)
+
+// otlpAppendTags appends the attributes to the tags, the later attributes override the former ones
+func otlpAppendTags(tags map[string]string, attrs []otlppb.KeyValue) map[string]string {
+	for i := range attrs {
+		tags[attrs[i].Key] = attrs[i].Value.String()
+	}
+	return tags
+}
+
+type otlpField struct {
+	key   string
+	value float64
+}
+
+// otlpLine returns the line with ns precision, the fields of NaN or Inf are skipped
+func otlpLine(name string, tags map[string]string, fields []otlpField, ts uint64) ([]byte, error) {
+	if name == "" {
+		return nil, ErrOTLPMissingName
+	}
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(util.EscapeMeasurement(name))
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(util.EscapeTag(k))
+		b.WriteByte('=')
+		b.WriteString(util.EscapeTag(tags[k]))
+	}
+	written := 0
+	for _, field := range fields {
+		if math.IsNaN(field.value) || math.IsInf(field.value, 0) {
+			continue
+		}
+		if written == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(util.EscapeTag(field.key))
+		b.WriteByte('=')
+		b.WriteString(otlpFloat(field.value))
+		written++
+	}
+	if written == 0 {
+		return nil, ErrOTLPNoFields
+	}
+	if ts == 0 {
+		ts = uint64(time.Now().UnixNano())
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatUint(ts, 10))
+	return []byte(b.String()), nil
+}
+
+func otlpFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// OTLPMetricToLines converts the data points of a metric into the lines with ns precision, the measurement is the metric name:
+// gauge and non-monotonic sum have the gauge field, monotonic sum has the counter field,
+// histogram has the count, sum, min, max fields and a cumulative count field for each bucket named by its upper bound,
+// summary has the count, sum fields and a field for each quantile
+func OTLPMetricToLines(m *otlppb.Metric, base map[string]string) (lines [][]byte, errs []error) {
+	add := func(attrs []otlppb.KeyValue, fields []otlpField, ts uint64) {
+		tags := make(map[string]string, len(base)+len(attrs))
+		for k, v := range base {
+			tags[k] = v
+		}
+		line, err := otlpLine(m.Name, otlpAppendTags(tags, attrs), fields, ts)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		lines = append(lines, line)
+	}
+	number := func(p *otlppb.NumberDataPoint, field string) {
+		var value float64
+		if p.AsDouble != nil {
+			value = *p.AsDouble
+		} else if p.AsInt != nil {
+			value = float64(*p.AsInt)
+		}
+		add(p.Attributes, []otlpField{{field, value}}, p.TimeUnixNano)
+	}
+
+	switch {
+	case m.Gauge != nil:
+		for i := range m.Gauge.DataPoints {
+			number(&m.Gauge.DataPoints[i], "gauge")
+		}
+	case m.Sum != nil:
+		field := "gauge"
+		if m.Sum.IsMonotonic {
+			field = "counter"
+		}
+		for i := range m.Sum.DataPoints {
+			number(&m.Sum.DataPoints[i], field)
+		}
+	case m.Histogram != nil:
+		for i := range m.Histogram.DataPoints {
+			p := &m.Histogram.DataPoints[i]
+			fields := []otlpField{{"count", float64(p.Count)}}
+			if p.Sum != nil {
+				fields = append(fields, otlpField{"sum", *p.Sum})
+			}
+			if p.Min != nil {
+				fields = append(fields, otlpField{"min", *p.Min})
+			}
+			if p.Max != nil {
+				fields = append(fields, otlpField{"max", *p.Max})
+			}
+			var cumulative uint64
+			for j, count := range p.BucketCounts {
+				cumulative += count
+				bound := "+Inf"
+				if j < len(p.ExplicitBounds) {
+					bound = otlpFloat(p.ExplicitBounds[j])
+				}
+				fields = append(fields, otlpField{bound, float64(cumulative)})
+			}
+			add(p.Attributes, fields, p.TimeUnixNano)
+		}
+	case m.Summary != nil:
+		for i := range m.Summary.DataPoints {
+			p := &m.Summary.DataPoints[i]
+			fields := []otlpField{{"count", float64(p.Count)}, {"sum", p.Sum}}
+			for _, q := range p.QuantileValues {
+				fields = append(fields, otlpField{otlpFloat(q.Quantile), q.Value})
+			}
+			add(p.Attributes, fields, p.TimeUnixNano)
+		}
+	}
+	return
+}
+
+// WriteOTLP writes the metrics, the tags are the resource attributes, the scope name, version and attributes,
+// and the data point attributes, the later ones override the former ones
+func (ip *Proxy) WriteOTLP(req *otlppb.ExportMetricsServiceRequest, db, rp string) error {
+	var wr writeResult
+	lineno := 0
+	for i := range req.ResourceMetrics {
+		rm := &req.ResourceMetrics[i]
+		for j := range rm.ScopeMetrics {
+			sm := &rm.ScopeMetrics[j]
+			base := otlpAppendTags(make(map[string]string), rm.Resource.Attributes)
+			base[OTLPScopeNameTag] = sm.Scope.Name
+			base[OTLPScopeVersionTag] = sm.Scope.Version
+			otlpAppendTags(base, sm.Scope.Attributes)
+			for k := range sm.Metrics {
+				m := &sm.Metrics[k]
+				lines, errs := OTLPMetricToLines(m, base)
+				for _, err := range errs {
+					lineno++
+					wr.add([]byte(m.Name), lineno, err)
+				}
+				for _, line := range lines {
+					lineno++
+					wr.add(line, lineno, ip.WriteRow(line, db, rp, "ns"))
+				}
+			}
+		}
+	}
+	ip.SyncWAL()
+	return wr.err()
+}
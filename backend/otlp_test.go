@@ -0,0 +1,100 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/otlppb"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestOTLPMetricToLines(t *testing.T) {
+	body := `{"resourceMetrics": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}]},
+		"scopeMetrics": [{
+			"scope": {"name": "meter", "version": "1.0"},
+			"metrics": [
+				{"name": "queue.size", "gauge": {"dataPoints": [{"asInt": "12", "timeUnixNano": "1596819659000000000",
+					"attributes": [{"key": "queue", "value": {"stringValue": "jobs"}}]}]}},
+				{"name": "requests", "sum": {"isMonotonic": true, "dataPoints": [{"asDouble": 42, "timeUnixNano": 1596819659000000000,
+					"attributes": [{"key": "service.name", "value": {"stringValue": "web"}}, {"key": "ok", "value": {"boolValue": true}}]}]}},
+				{"name": "latency", "histogram": {"dataPoints": [{"timeUnixNano": "1596819659000000000", "count": "6", "sum": 9.5,
+					"bucketCounts": ["1", "2", "3"], "explicitBounds": [0.5, 1]}]}},
+				{"name": "size", "summary": {"dataPoints": [{"timeUnixNano": "1596819659000000000", "count": "3", "sum": 30,
+					"quantileValues": [{"quantile": 0.5, "value": 10}, {"quantile": 0.99, "value": 18}]}]}}
+			]
+		}]
+	}]}`
+	var req otlppb.ExportMetricsServiceRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	want := []string{
+		"queue.size,otel.scope.name=meter,otel.scope.version=1.0,queue=jobs,service.name=api gauge=12 1596819659000000000",
+		"requests,ok=true,otel.scope.name=meter,otel.scope.version=1.0,service.name=web counter=42 1596819659000000000",
+		"latency,otel.scope.name=meter,otel.scope.version=1.0,service.name=api count=6,sum=9.5,0.5=1,1=3,+Inf=6 1596819659000000000",
+		"size,otel.scope.name=meter,otel.scope.version=1.0,service.name=api count=3,sum=30,0.5=10,0.99=18 1596819659000000000",
+	}
+	base := map[string]string{"service.name": "api", OTLPScopeNameTag: "meter", OTLPScopeVersionTag: "1.0"}
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != len(want) {
+		t.Fatalf("got %d metrics, want %d", len(metrics), len(want))
+	}
+	for i := range metrics {
+		lines, errs := OTLPMetricToLines(&metrics[i], base)
+		if len(errs) > 0 || len(lines) != 1 || string(lines[0]) != want[i] {
+			t.Errorf("%v: got %s %v, want %s", metrics[i].Name, lines, errs, want[i])
+		}
+	}
+
+	nan := math.NaN()
+	m := &otlppb.Metric{Name: "nan", Gauge: &otlppb.Gauge{DataPoints: []otlppb.NumberDataPoint{{AsDouble: &nan}}}}
+	if _, errs := OTLPMetricToLines(m, nil); len(errs) != 1 || errs[0] != ErrOTLPNoFields {
+		t.Errorf("expect ErrOTLPNoFields, got %v", errs)
+	}
+}
+
+func TestOTLPUnmarshalProto(t *testing.T) {
+	appendMessage := func(b []byte, num protowire.Number, m []byte) []byte {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, m)
+	}
+	var attr, value, point, sum, metric, scope, rm, req []byte
+	value = protowire.AppendTag(value, 1, protowire.BytesType)
+	value = protowire.AppendString(value, "web01")
+	attr = protowire.AppendTag(attr, 1, protowire.BytesType)
+	attr = protowire.AppendString(attr, "host")
+	attr = appendMessage(attr, 2, value)
+	point = appendMessage(point, 7, attr)
+	point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, 1596819659000000000)
+	point = protowire.AppendTag(point, 6, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, 7)
+	sum = appendMessage(sum, 1, point)
+	sum = protowire.AppendTag(sum, 3, protowire.VarintType)
+	sum = protowire.AppendVarint(sum, 1)
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, "requests")
+	metric = appendMessage(metric, 7, sum)
+	scope = appendMessage(scope, 2, metric)
+	rm = appendMessage(rm, 2, scope)
+	req = appendMessage(req, 1, rm)
+
+	var mr otlppb.ExportMetricsServiceRequest
+	if err := mr.Unmarshal(req); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	lines, errs := OTLPMetricToLines(&mr.ResourceMetrics[0].ScopeMetrics[0].Metrics[0], nil)
+	want := "requests,host=web01 counter=7 1596819659000000000"
+	if len(errs) > 0 || len(lines) != 1 || string(lines[0]) != want {
+		t.Errorf("got %s %v, want %s", lines, errs, want)
+	}
+	if err := mr.Unmarshal(req[:len(req)-1]); err == nil {
+		t.Error("expect error")
+	}
+}
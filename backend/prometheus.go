@@ -0,0 +1,218 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/prompb"
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+const (
+	PromMetricNameLabel = "__name__"
+	PromValueField      = "value"
+)
+
+var (
+	ErrPromMissingName  = errors.New("prometheus time series missing metric name")
+	ErrPromNameMatcher  = errors.New("prometheus query requires an equal matcher on __name__")
+	ErrPromInvalidMatch = errors.New("prometheus query has an invalid matcher type")
+)
+
+// PromTimeSeriesToLines converts the samples of a time series into the line protocol with ms precision,
+// the metric name is the measurement unless meas is given, in which case it's kept as the __name__ tag
+func PromTimeSeriesToLines(ts *prompb.TimeSeries, meas string) ([][]byte, error) {
+	labels := make([]prompb.Label, 0, len(ts.Labels))
+	name := ""
+	for _, label := range ts.Labels {
+		if label.Name == PromMetricNameLabel {
+			name = label.Value
+			if meas == "" {
+				continue
+			}
+		}
+		// the line protocol doesn't support empty tag values
+		if label.Value != "" {
+			labels = append(labels, label)
+		}
+	}
+	if name == "" {
+		return nil, ErrPromMissingName
+	}
+	if meas == "" {
+		meas = name
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	var b strings.Builder
+	b.WriteString(util.EscapeMeasurement(meas))
+	for _, label := range labels {
+		b.WriteByte(',')
+		b.WriteString(util.EscapeTag(label.Name))
+		b.WriteByte('=')
+		b.WriteString(util.EscapeTag(label.Value))
+	}
+	b.WriteString(" " + PromValueField + "=")
+	prefix := b.String()
+
+	lines := make([][]byte, 0, len(ts.Samples))
+	for _, sample := range ts.Samples {
+		// the line protocol doesn't support NaN and Inf, such as the stale markers
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		line := make([]byte, 0, len(prefix)+32)
+		line = append(line, prefix...)
+		line = strconv.AppendFloat(line, sample.Value, 'f', -1, 64)
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, sample.Timestamp, 10)
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// WritePrometheus writes the samples of a remote write request, the measurement is the metric name unless meas is given
+func (ip *Proxy) WritePrometheus(req *prompb.WriteRequest, db, rp, meas string) error {
+	var wr writeResult
+	for i := range req.Timeseries {
+		lines, err := PromTimeSeriesToLines(&req.Timeseries[i], meas)
+		if err != nil {
+			wr.add(nil, i+1, err)
+			continue
+		}
+		for _, line := range lines {
+			wr.add(line, i+1, ip.WriteRow(line, db, rp, "ms"))
+		}
+	}
+	ip.SyncWAL()
+	return wr.err()
+}
+
+func promRegexp(re string) string {
+	return "/^(?:" + strings.ReplaceAll(re, "/", `\/`) + ")$/"
+}
+
+func promString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// PromQueryToInfluxQL translates the label matchers of a remote read query into a select statement,
+// it returns the metric name to restore as the __name__ label, which is empty when meas is given
+func PromQueryToInfluxQL(q *prompb.Query, rp, meas string) (iql string, name string, err error) {
+	conds := []string{fmt.Sprintf("time >= %dms", q.StartTimestampMs), fmt.Sprintf("time <= %dms", q.EndTimestampMs)}
+	for _, m := range q.Matchers {
+		if m.Name == PromMetricNameLabel && meas == "" {
+			if m.Type != prompb.MatchEqual || m.Value == "" {
+				return "", "", ErrPromNameMatcher
+			}
+			name = m.Value
+			continue
+		}
+		tag := "\"" + util.EscapeIdentifier(m.Name) + "\""
+		switch m.Type {
+		case prompb.MatchEqual:
+			conds = append(conds, tag+" = "+promString(m.Value))
+		case prompb.MatchNotEqual:
+			conds = append(conds, tag+" != "+promString(m.Value))
+		case prompb.MatchRegexp:
+			conds = append(conds, tag+" =~ "+promRegexp(m.Value))
+		case prompb.MatchNotRegexp:
+			conds = append(conds, tag+" !~ "+promRegexp(m.Value))
+		default:
+			return "", "", ErrPromInvalidMatch
+		}
+	}
+	if meas == "" {
+		if name == "" {
+			return "", "", ErrPromNameMatcher
+		}
+		meas = name
+	}
+	from := "\"" + util.EscapeIdentifier(meas) + "\""
+	if rp != "" {
+		from = "\"" + util.EscapeIdentifier(rp) + "\"." + from
+	}
+	iql = fmt.Sprintf("SELECT %s FROM %s WHERE %s GROUP BY *", PromValueField, from, strings.Join(conds, " AND "))
+	return
+}
+
+// PromSeriesToTimeSeries converts the series queried with ms epoch into the time series, adding the __name__ label if name is given
+func PromSeriesToTimeSeries(series models.Rows, name string) []prompb.TimeSeries {
+	tss := make([]prompb.TimeSeries, 0, len(series))
+	for _, row := range series {
+		ti, vi := -1, -1
+		for i, col := range row.Columns {
+			switch col {
+			case "time":
+				ti = i
+			case PromValueField:
+				vi = i
+			}
+		}
+		if ti == -1 || vi == -1 {
+			continue
+		}
+		ts := prompb.TimeSeries{Labels: make([]prompb.Label, 0, len(row.Tags)+1)}
+		if name != "" {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: PromMetricNameLabel, Value: name})
+		}
+		for k, v := range row.Tags {
+			if v != "" {
+				ts.Labels = append(ts.Labels, prompb.Label{Name: k, Value: v})
+			}
+		}
+		sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+		for _, value := range row.Values {
+			if value[vi] == nil {
+				continue
+			}
+			ts.Samples = append(ts.Samples, prompb.Sample{
+				Value:     toFloat(normalizeValue(value[vi])),
+				Timestamp: timeToNano(normalizeValue(value[ti])),
+			})
+		}
+		tss = append(tss, ts)
+	}
+	return tss
+}
+
+// ReadPrometheus executes the queries of a remote read request, the measurement is the metric name unless meas is given
+func (ip *Proxy) ReadPrometheus(req *prompb.ReadRequest, db, rp, meas string) (*prompb.ReadResponse, error) {
+	resp := &prompb.ReadResponse{Results: make([]prompb.QueryResult, len(req.Queries))}
+	for i := range req.Queries {
+		q, name, err := PromQueryToInfluxQL(&req.Queries[i], rp, meas)
+		if err != nil {
+			return nil, err
+		}
+		qreq := NewQueryRequest("GET", db, q, "ms")
+		qreq.URL = &url.URL{}
+		// let the transport decompress the body
+		qreq.Header.Del("Accept-Encoding")
+		tokens, _, _ := CheckQuery(q)
+		body, err := QueryFromQL(nil, qreq, ip, tokens, db)
+		if err != nil {
+			return nil, err
+		}
+		results, err := ResultsFromResponseBytes(body)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) > 0 {
+			if results[0].Err != "" {
+				return nil, errors.New(results[0].Err)
+			}
+			resp.Results[i].Timeseries = PromSeriesToTimeSeries(results[0].Series, name)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/prompb"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestPromTimeSeriesToLines(t *testing.T) {
+	req := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: "http_requests_total"},
+					{Name: "method", Value: "GET"},
+					{Name: "handler", Value: "/api v1"},
+					{Name: "empty", Value: ""},
+				},
+				Samples: []prompb.Sample{
+					{Value: 1.5, Timestamp: 1596819659000},
+					{Value: math.NaN(), Timestamp: 1596819660000},
+					{Value: 1000000, Timestamp: 1596819661000},
+				},
+			},
+		},
+	}
+	// round trip through the protobuf encoding
+	var decoded prompb.WriteRequest
+	if err := decoded.Unmarshal(req.Marshal(nil)); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	ts := &decoded.Timeseries[0]
+	if len(ts.Labels) != 4 || len(ts.Samples) != 3 || ts.Samples[2].Timestamp != 1596819661000 {
+		t.Fatalf("unexpected decoded time series: %+v", ts)
+	}
+
+	tests := []struct {
+		name string
+		meas string
+		want []string
+	}{
+		{
+			name: "metric",
+			meas: "",
+			want: []string{
+				`http_requests_total,handler=/api\ v1,method=GET value=1.5 1596819659000`,
+				`http_requests_total,handler=/api\ v1,method=GET value=1000000 1596819661000`,
+			},
+		},
+		{
+			name: "single",
+			meas: "prometheus",
+			want: []string{
+				`prometheus,__name__=http_requests_total,handler=/api\ v1,method=GET value=1.5 1596819659000`,
+				`prometheus,__name__=http_requests_total,handler=/api\ v1,method=GET value=1000000 1596819661000`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		lines, err := PromTimeSeriesToLines(ts, tt.meas)
+		if err != nil {
+			t.Errorf("%v: error: %s", tt.name, err)
+			continue
+		}
+		got := make([]string, len(lines))
+		for i, line := range lines {
+			got[i] = string(line)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := PromTimeSeriesToLines(&prompb.TimeSeries{Labels: []prompb.Label{{Name: "job", Value: "x"}}}, ""); err != ErrPromMissingName {
+		t.Errorf("expect ErrPromMissingName, got %v", err)
+	}
+}
+
+func TestPromQueryToInfluxQL(t *testing.T) {
+	q := &prompb.Query{
+		StartTimestampMs: 1596819659000,
+		EndTimestampMs:   1596819959000,
+		Matchers: []prompb.LabelMatcher{
+			{Type: prompb.MatchEqual, Name: "__name__", Value: "http_requests_total"},
+			{Type: prompb.MatchEqual, Name: "method", Value: "GET"},
+			{Type: prompb.MatchNotEqual, Name: "code", Value: "it's"},
+			{Type: prompb.MatchRegexp, Name: "handler", Value: "/api/.*"},
+			{Type: prompb.MatchNotRegexp, Name: "job", Value: ""},
+		},
+	}
+	var decoded prompb.ReadRequest
+	if err := decoded.Unmarshal((&prompb.ReadRequest{Queries: []prompb.Query{*q}}).Marshal(nil)); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	q = &decoded.Queries[0]
+
+	iql, name, err := PromQueryToInfluxQL(q, "", "")
+	want := `SELECT value FROM "http_requests_total" WHERE time >= 1596819659000ms AND time <= 1596819959000ms AND "method" = 'GET' AND "code" != 'it\'s' AND "handler" =~ /^(?:\/api\/.*)$/ AND "job" !~ /^(?:)$/ GROUP BY *`
+	if err != nil || iql != want || name != "http_requests_total" {
+		t.Errorf("got %s %s %v, want %s", iql, name, err, want)
+	}
+	tokens, check, from := CheckQuery(iql)
+	if meas, err := GetMeasurementFromTokens(tokens); !check || !from || err != nil || meas != "http_requests_total" {
+		t.Errorf("unexpected measurement %s of %s", meas, iql)
+	}
+
+	iql, name, err = PromQueryToInfluxQL(q, "autogen", "prometheus")
+	want = `SELECT value FROM "autogen"."prometheus" WHERE time >= 1596819659000ms AND time <= 1596819959000ms AND "__name__" = 'http_requests_total' AND "method" = 'GET' AND "code" != 'it\'s' AND "handler" =~ /^(?:\/api\/.*)$/ AND "job" !~ /^(?:)$/ GROUP BY *`
+	if err != nil || iql != want || name != "" {
+		t.Errorf("got %s %s %v, want %s", iql, name, err, want)
+	}
+
+	q.Matchers[0].Type = prompb.MatchRegexp
+	if _, _, err = PromQueryToInfluxQL(q, "", ""); err != ErrPromNameMatcher {
+		t.Errorf("expect ErrPromNameMatcher, got %v", err)
+	}
+}
+
+func TestPromSeriesToTimeSeries(t *testing.T) {
+	series := models.Rows{
+		{
+			Name:    "http_requests_total",
+			Tags:    map[string]string{"method": "GET", "code": ""},
+			Columns: []string{"time", "value"},
+			Values: [][]interface{}{
+				{json.Number("1596819659000"), json.Number("1.5")},
+				{json.Number("1596819660000"), nil},
+				{json.Number("1596819661000"), json.Number("2")},
+			},
+		},
+	}
+	want := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "method", Value: "GET"}},
+			Samples: []prompb.Sample{{Value: 1.5, Timestamp: 1596819659000}, {Value: 2, Timestamp: 1596819661000}},
+		},
+	}
+	resp := &prompb.ReadResponse{Results: []prompb.QueryResult{{Timeseries: PromSeriesToTimeSeries(series, "http_requests_total")}}}
+	var decoded prompb.ReadResponse
+	if err := decoded.Unmarshal(resp.Marshal(nil)); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	if !reflect.DeepEqual(decoded.Results[0].Timeseries, want) {
+		t.Errorf("got %+v, want %+v", decoded.Results[0].Timeseries, want)
+	}
+}
@@ -5,7 +5,10 @@
 package backend
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -19,21 +22,56 @@ import (
 )
 
 type Proxy struct {
-	Circles []*Circle
-	DBSet   util.Set
+	Circles         []*Circle
+	DBSet           util.Set
+	ShardRules      *ShardRules
+	WriteRules      []*WriteRule
+	FilterRules     []*FilterRule
+	LineListeners   []*LineListener
+	BucketMapping   map[string][2]string
+	WriteValidation string
+	MaxLineSize     int
+	walEnabled      bool
+	ackTimeout      time.Duration
+	cfg             *ProxyConfig
+	lock            sync.RWMutex
+	reloadLock      sync.Mutex
+}
+
+// ackTimeout is long enough for a point to wait for the slowest flush policy and the write to the backend
+func ackTimeout(cfg *ProxyConfig) time.Duration {
+	return (NewFlushPolicies(cfg).MaxTime() + time.Duration(cfg.WriteTimeout)*time.Second) * 2
 }
 
 func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
 	ip = &Proxy{
-		Circles: make([]*Circle, len(cfg.Circles)),
-		DBSet:   util.NewSet(),
+		Circles:         make([]*Circle, len(cfg.Circles)),
+		DBSet:           util.NewSet(),
+		BucketMapping:   make(map[string][2]string),
+		ShardRules:      NewShardRules(cfg.ShardRules),
+		WriteValidation: cfg.WriteValidation,
+		MaxLineSize:     cfg.MaxLineSize,
+		walEnabled:      cfg.WALEnabled,
+		ackTimeout:      ackTimeout(cfg),
+		cfg:             cfg,
 	}
+	// the write and filter rules have been checked by checkConfig
+	ip.WriteRules, _ = NewWriteRules(cfg.WriteRules)
+	ip.FilterRules, _ = NewFilterRules(cfg.FilterRules)
 	for idx, circfg := range cfg.Circles {
 		ip.Circles[idx] = NewCircle(circfg, cfg, idx)
 	}
 	for _, db := range cfg.DBList {
 		ip.DBSet.Add(db)
 	}
+	for _, llcfg := range cfg.LineProtocol {
+		if llcfg.Enabled {
+			ip.LineListeners = append(ip.LineListeners, NewLineListener(llcfg))
+		}
+	}
+	for _, mapping := range cfg.BucketMapping {
+		ip.BucketMapping[mapping.Bucket] = [2]string{mapping.Database, mapping.RetentionPolicy}
+	}
 	rand.Seed(time.Now().UnixNano())
 	return
 }
@@ -47,6 +85,17 @@ func GetKey(db, meas string) string {
 	return b.String()
 }
 
+// GetDatabaseFromBucket maps the bucket of InfluxDB 2.x to db and rp by bucket_mapping, or by the form of db/rp
+func (ip *Proxy) GetDatabaseFromBucket(bucket string) (db, rp string) {
+	if m, ok := ip.BucketMapping[bucket]; ok {
+		return m[0], m[1]
+	}
+	if i := strings.IndexByte(bucket, '/'); i >= 0 {
+		return bucket[:i], bucket[i+1:]
+	}
+	return bucket, ""
+}
+
 func (ip *Proxy) GetBackends(key string) []*Backend {
 	backends := make([]*Backend, len(ip.Circles))
 	for i, circle := range ip.Circles {
@@ -55,6 +104,32 @@ func (ip *Proxy) GetBackends(key string) []*Backend {
 	return backends
 }
 
+// queryCircles returns the circles to query in order, where the backends of a circle are picked by backends:
+// the circles whose backends are active and neither rewriting nor write-only first in random order,
+// and then the circles whose backends are active but rewriting or write-only
+func (ip *Proxy) queryCircles(backends func(*Circle) []*Backend) []*Circle {
+	perms := rand.Perm(len(ip.Circles))
+	circles := make([]*Circle, 0, len(perms))
+	var writings []*Circle
+	for _, p := range perms {
+		circle := ip.Circles[p]
+		active, writing := true, false
+		for _, be := range backends(circle) {
+			active = active && be.IsActive()
+			writing = writing || be.IsRewriting() || be.IsWriteOnly()
+		}
+		if !active {
+			continue
+		}
+		if writing {
+			writings = append(writings, circle)
+		} else {
+			circles = append(circles, circle)
+		}
+	}
+	return append(circles, writings...)
+}
+
 func (ip *Proxy) GetHealth(stats bool) []interface{} {
 	var wg sync.WaitGroup
 	health := make([]interface{}, len(ip.Circles))
@@ -69,6 +144,26 @@ func (ip *Proxy) GetHealth(stats bool) []interface{} {
 	return health
 }
 
+func (ip *Proxy) GetStats() map[string]interface{} {
+	filterStats := make([]*FilterRuleStats, len(ip.FilterRules))
+	for i, fr := range ip.FilterRules {
+		filterStats[i] = fr.Stats()
+	}
+	ruleStats := make([]*WriteRuleStats, len(ip.WriteRules))
+	for i, wr := range ip.WriteRules {
+		ruleStats[i] = wr.Stats()
+	}
+	listenerStats := make([]*LineListenerStats, len(ip.LineListeners))
+	for i, ll := range ip.LineListeners {
+		listenerStats[i] = ll.Stats()
+	}
+	return map[string]interface{}{
+		"filter_rules":  filterStats,
+		"write_rules":   ruleStats,
+		"line_protocol": listenerStats,
+	}
+}
+
 func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, err error) {
 	q := strings.TrimSpace(req.FormValue("q"))
 	if q == "" {
@@ -91,7 +186,7 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 		if db == "" {
 			return nil, ErrDatabaseNotFound
 		}
-		if db == "_internal" || (len(ip.DBSet) > 0 && !ip.DBSet[db]) {
+		if db == "_internal" || !ip.AllowDatabase(db) {
 			return nil, fmt.Errorf("database forbidden: %s", db)
 		}
 	}
@@ -109,50 +204,290 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 	return nil, ErrIllegalQL
 }
 
+// SyncWAL commits the wal of all the backends to the disk, so that the written points are durable before acknowledged
+func (ip *Proxy) SyncWAL() {
+	if !ip.walEnabled {
+		return
+	}
+	for _, circle := range ip.Circles {
+		for _, be := range circle.Backends {
+			be.SyncWAL()
+		}
+	}
+}
+
+// Close closes all the backends, and waits until their buffers are drained or the context is done
+func (ip *Proxy) Close(ctx context.Context) error {
+	var stopped []<-chan struct{}
+	for _, circle := range ip.Circles {
+		for _, be := range circle.Backends {
+			stopped = append(stopped, be.Close())
+		}
+	}
+	for _, ch := range stopped {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (ip *Proxy) NewWriteTracker(level ConsistencyLevel) *WriteTracker {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+	return NewWriteTracker(level, len(ip.Circles), ip.ackTimeout)
+}
+
+// AllowDatabase reports whether the database is permitted by db_list
+func (ip *Proxy) AllowDatabase(db string) bool {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+	return len(ip.DBSet) == 0 || ip.DBSet[db]
+}
+
+// Config returns the config in effect, which is replaced rather than modified by Reload
+func (ip *Proxy) Config() *ProxyConfig {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+	return ip.cfg
+}
+
 func (ip *Proxy) Write(p []byte, db, rp, precision string) (err error) {
-	buf := bytes.NewBuffer(p)
-	var line []byte
-	for {
-		line, err = buf.ReadBytes('\n')
-		switch err {
-		default:
-			log.Printf("error: %s", err)
-			return
-		case io.EOF, nil:
-			err = nil
-		}
-		if len(line) == 0 {
-			break
-		}
-		ip.WriteRow(line, db, rp, precision)
+	return ip.WriteWithTracker(p, db, rp, precision, nil)
+}
+
+func (ip *Proxy) WriteWithTracker(p []byte, db, rp, precision string, wt *WriteTracker) error {
+	return ip.WriteReader(bytes.NewReader(p), db, rp, precision, wt)
+}
+
+// WriteReader scans the lines from the reader with a bounded buffer and writes each line as it is scanned,
+// it stops with ErrLineTooLong when a line exceeds max_line_size, or with the error of the reader,
+// and the lines scanned before are still written
+func (ip *Proxy) WriteReader(r io.Reader, db, rp, precision string, wt *WriteTracker) (err error) {
+	_, err = ip.write(r, db, rp, precision, wt)
+	ip.SyncWAL()
+	return
+}
+
+// write returns the number of points written without error, and leaves the wal to be synced by the caller
+func (ip *Proxy) write(r io.Reader, db, rp, precision string, wt *WriteTracker) (n int, err error) {
+	ip.lock.RLock()
+	maxLineSize := ip.MaxLineSize
+	ip.lock.RUnlock()
+	if maxLineSize <= 0 {
+		maxLineSize = bufio.MaxScanTokenSize
+	}
+	bufSize := 4096
+	if bufSize > maxLineSize {
+		bufSize = maxLineSize
+	}
+	// the scanner still returns the incomplete last line on error, so the split stops at the error instead
+	er := &errReader{r: r}
+	scanner := bufio.NewScanner(er)
+	scanner.Buffer(make([]byte, bufSize), maxLineSize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && er.err != nil && bytes.IndexByte(data, '\n') < 0 {
+			return 0, nil, er.err
+		}
+		return bufio.ScanLines(data, atEOF && er.err == nil)
+	})
+	var wr writeResult
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		if IsSkipLine(scanner.Bytes()) {
+			continue
+		}
+		// copy the line since the scanner reuses its buffer while the point is buffered asynchronously
+		line := append([]byte(nil), scanner.Bytes()...)
+		rerr := ip.writeRow(line, db, rp, precision, wt)
+		if rerr == nil {
+			n++
+		}
+		wr.add(line, lineno, rerr)
+	}
+	if err = scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			err = ErrLineTooLong
+		}
+		return
+	}
+	return n, wr.err()
+}
+
+// errReader records the error of the reader except io.EOF
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *errReader) Read(p []byte) (n int, err error) {
+	n, err = er.r.Read(p)
+	if err != nil && err != io.EOF {
+		er.err = err
 	}
 	return
 }
 
-func (ip *Proxy) WriteRow(line []byte, db, rp, precision string) {
-	nanoLine := AppendNano(line, precision)
-	meas, err := ScanKey(nanoLine)
-	if err != nil {
-		log.Printf("scan key error: %s", err)
+// WriteLines writes the lines converted from other protocols, in the same way as Write
+func (ip *Proxy) WriteLines(lines [][]byte, db, rp, precision string) error {
+	var wr writeResult
+	for i, line := range lines {
+		wr.add(line, i+1, ip.writeRow(line, db, rp, precision, nil))
+	}
+	ip.SyncWAL()
+	return wr.err()
+}
+
+// writeResult collects the errors of the lines in a write request
+type writeResult struct {
+	pwe        *PartialWriteError
+	failed     error
+	overloaded bool
+	written    int
+}
+
+func (wr *writeResult) add(line []byte, lineno int, err error) {
+	if err == nil {
+		wr.written++
 		return
 	}
-	if !RapidCheck(nanoLine[len(meas):]) {
-		log.Printf("invalid format, drop data: %s %s %s %s", db, rp, precision, string(line))
+	if errors.Is(err, ErrBufferFailed) {
+		// the line is valid but not durable, which is not a partial write
+		if wr.failed == nil {
+			wr.failed = err
+		}
 		return
 	}
+	if err == ErrBackendOverloaded {
+		wr.overloaded = true
+	} else if errors.Is(err, ErrBackendOverloaded) {
+		// the line is buffered by the other circles, only the rejected copies are reported
+		wr.written++
+	}
+	if wr.pwe == nil {
+		wr.pwe = &PartialWriteError{}
+	}
+	wr.pwe.Add(line, lineno, err)
+}
+
+func (wr *writeResult) err() error {
+	if wr.failed != nil {
+		return wr.failed
+	}
+	// the client can retry the whole request only when no line has been buffered,
+	// otherwise the overloaded lines are reported as a partial write to avoid duplicates
+	if wr.overloaded && wr.written == 0 {
+		return ErrBackendOverloaded
+	}
+	if wr.pwe != nil {
+		return wr.pwe
+	}
+	return nil
+}
+
+func (ip *Proxy) WriteRow(line []byte, db, rp, precision string) error {
+	return ip.writeRow(line, db, rp, precision, nil)
+}
+
+func (ip *Proxy) writeRow(line []byte, db, rp, precision string, wt *WriteTracker) error {
+	if precision == "" || precision == "n" {
+		precision = "ns"
+	}
+	tsLine := AppendTime(line, precision)
+	meas, err := ScanKey(tsLine)
+	if err != nil {
+		return ErrMissingFields
+	}
+	ip.lock.RLock()
+	strict := ip.WriteValidation == "strict"
+	ip.lock.RUnlock()
+	if strict {
+		err = StrictCheck(tsLine, precision)
+		if err != nil {
+			return err
+		}
+	} else if !RapidCheck(tsLine[len(meas):]) {
+		return ErrInvalidFormat
+	}
+	if len(ip.FilterRules) > 0 {
+		var ok bool
+		var fdb string
+		fdb, rp, ok = ApplyFilterRules(ip.FilterRules, db, rp, meas, tsLine)
+		if !ok {
+			return nil
+		}
+		if fdb != db && !ip.AllowDatabase(fdb) {
+			return ErrRedirectForbidden
+		}
+		db = fdb
+	}
+	if len(ip.WriteRules) > 0 {
+		tsLine, err = ApplyWriteRules(ip.WriteRules, db, meas, tsLine)
+		if err != nil {
+			return err
+		}
+		if tsLine == nil {
+			// all the fields are dropped
+			return nil
+		}
+		meas, _ = ScanKey(tsLine)
+	}
 
 	key := GetKey(db, meas)
+	if tags := ip.ShardRules.Tags(db, meas); len(tags) > 0 {
+		key = GetShardKey(key, tsLine, tags)
+	}
 	backends := ip.GetBackends(key)
 	if len(backends) == 0 {
 		log.Printf("write data error: can't get backends")
-		return
+		return nil
 	}
 
-	point := &LinePoint{db, rp, nanoLine}
-	for _, be := range backends {
-		err := be.WritePoint(point)
+	// each circle admits the point on its own, so that an overloaded circle doesn't block the healthy ones
+	var rejected []string
+	rejecting := make([]bool, len(backends))
+	for i, be := range backends {
+		if be.IsRejecting() {
+			rejecting[i] = true
+			rejected = append(rejected, be.Url)
+		}
+	}
+	if len(rejected) == len(backends) {
+		return ErrBackendOverloaded
+	}
+	point := &LinePoint{Db: db, Rp: rp, Precision: precision, Line: tsLine}
+	var failed error
+	for i, be := range backends {
+		var ack *WriteAck
+		if wt != nil {
+			// each circle acknowledges its own copy of the point
+			ack = wt.Ack(i)
+			ack.Add(1)
+			point = &LinePoint{Db: db, Rp: rp, Precision: precision, Line: tsLine, Ack: ack}
+		}
+		if rejecting[i] {
+			if ack != nil {
+				ack.Done(1, FlushDropped)
+			}
+			continue
+		}
+		err := be.writePoint(point)
 		if err != nil {
 			log.Printf("write data to buffer error: %s, %s, %s, %s, %s, %s", err, be.Url, db, rp, precision, string(line))
+			if ack != nil {
+				ack.Done(1, FlushDropped)
+			}
+			failed = fmt.Errorf("%w: %s: %s", ErrBufferFailed, be.Url, err)
 		}
 	}
+	if failed != nil {
+		return failed
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("%w: %s", ErrBackendOverloaded, strings.Join(rejected, ","))
+	}
+	return nil
 }
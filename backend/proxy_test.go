@@ -0,0 +1,87 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+type failReader struct{}
+
+func (failReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestProxyWriteReader(t *testing.T) {
+	ip := &Proxy{ShardRules: NewShardRules(nil), MaxLineSize: 32}
+	body := "cpu value=1 1596819659\n\n# comment\nmem value=2\ncpu\n"
+	err := ip.WriteReader(strings.NewReader(body), "db", "", "s", nil)
+	pwe, ok := err.(*PartialWriteError)
+	if !ok || len(pwe.Errors) != 1 || pwe.Errors[0].Lineno != 5 {
+		t.Errorf("expect partial write error of line 5, got %v", err)
+	}
+	body = "cpu value=1\n" + strings.Repeat("a", 64) + " value=1\n"
+	if err = ip.WriteReader(strings.NewReader(body), "db", "", "s", nil); err != ErrLineTooLong {
+		t.Errorf("expect ErrLineTooLong, got %v", err)
+	}
+
+	// the incomplete last line before the reading error is not written
+	r := io.MultiReader(strings.NewReader("cpu value=1\nmem value=2\ncpu val"), failReader{})
+	if n, err := ip.write(r, "db", "", "s", nil); n != 2 || err == nil || err.Error() != "read failed" {
+		t.Errorf("expect 2 points and the reading error, got %d %v", n, err)
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	var wr writeResult
+	wr.add([]byte("cpu value=1"), 1, ErrBackendOverloaded)
+	wr.add([]byte("cpu"), 2, ErrMissingFields)
+	if err := wr.err(); err != ErrBackendOverloaded {
+		t.Errorf("expect ErrBackendOverloaded when no line is buffered, got %v", err)
+	}
+
+	// a retry would duplicate the buffered line, so the overloaded one is reported as a partial write
+	wr.add([]byte("mem value=1"), 3, nil)
+	pwe, ok := wr.err().(*PartialWriteError)
+	if !ok || pwe.Dropped != 2 || pwe.Errors[0].Err != ErrBackendOverloaded {
+		t.Errorf("expect partial write error of 2 lines, got %v", wr.err())
+	}
+
+	// a line rejected by some circles only is buffered by the others
+	wr = writeResult{}
+	wr.add([]byte("cpu value=1"), 1, fmt.Errorf("%w: %s", ErrBackendOverloaded, "http://127.0.0.1:8086"))
+	pwe, ok = wr.err().(*PartialWriteError)
+	if !ok || pwe.Dropped != 1 || wr.written != 1 {
+		t.Errorf("expect partial write error of the rejected copy, got %v", wr.err())
+	}
+}
+
+func newQueryCircle(active, rewriting, writeOnly bool) *Circle {
+	hb := &HttpBackend{}
+	hb.active.Store(active)
+	hb.rewriting.Store(rewriting)
+	hb.writeOnly.Store(writeOnly)
+	return &Circle{Backends: []*Backend{{HttpBackend: hb}}}
+}
+
+func TestQueryCircles(t *testing.T) {
+	inactive := newQueryCircle(false, false, false)
+	rewriting := newQueryCircle(true, true, false)
+	writeOnly := newQueryCircle(true, false, true)
+	available := newQueryCircle(true, false, false)
+	ip := &Proxy{Circles: []*Circle{inactive, rewriting, writeOnly, available}}
+	for i := 0; i < 10; i++ {
+		circles := ip.queryCircles(func(circle *Circle) []*Backend {
+			return circle.Backends
+		})
+		if len(circles) != 3 || circles[0] != available {
+			t.Fatalf("expect the available circle first and the inactive one skipped, got %v", circles)
+		}
+	}
+}
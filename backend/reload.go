@@ -0,0 +1,148 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+var ErrCirclesChanged = errors.New("circles changed, which requires rebalance and restart, reload with force to apply the other fields")
+
+// Reload re-reads the config file and applies the safe fields to the proxy and backends,
+// the changes of circles, backends and hash_key are refused unless forced, and take effect after restart as the other fields
+func (ip *Proxy) Reload(force bool) (cfg *ProxyConfig, err error) {
+	ip.reloadLock.Lock()
+	defer ip.reloadLock.Unlock()
+
+	cur := ip.Config()
+	next, err := NewFileConfig(cur.file)
+	if err != nil {
+		return nil, err
+	}
+	if changes := diffCircles(cur, next); len(changes) > 0 {
+		if !force {
+			return nil, fmt.Errorf("%w: %s", ErrCirclesChanged, strings.Join(changes, ", "))
+		}
+		log.Printf("reload forced, circles take effect after restart: %s", strings.Join(changes, ", "))
+	}
+	cfg = mergeReloadable(cur, next)
+	if keys := diffKeys(cfg, next); len(keys) > 0 {
+		log.Printf("reload skipped, take effect after restart: %s", strings.Join(keys, ", "))
+	}
+
+	dbSet := util.NewSet()
+	for _, db := range cfg.DBList {
+		dbSet.Add(db)
+	}
+	ip.lock.Lock()
+	ip.DBSet = dbSet
+	ip.WriteValidation = cfg.WriteValidation
+	ip.MaxLineSize = cfg.MaxLineSize
+	ip.ackTimeout = ackTimeout(cfg)
+	ip.cfg = cfg
+	ip.lock.Unlock()
+	for i, circle := range ip.Circles {
+		for j, be := range circle.Backends {
+			be.Reload(cfg.Circles[i].Backends[j], cfg)
+		}
+	}
+	log.Printf("config reloaded from %s", cfg.file)
+	return
+}
+
+// mergeReloadable copies the safe fields of the next config onto a copy of the current one,
+// including the credentials of the backends with the same name and url
+func mergeReloadable(cur, next *ProxyConfig) *ProxyConfig {
+	cfg := *cur
+	cfg.DBList = next.DBList
+	cfg.Username = next.Username
+	cfg.Password = next.Password
+	cfg.AuthEncrypt = next.AuthEncrypt
+	cfg.WriteTracing = next.WriteTracing
+	cfg.QueryTracing = next.QueryTracing
+	cfg.WriteTimeout = next.WriteTimeout
+	cfg.ShutdownTimeout = next.ShutdownTimeout
+	cfg.FlushSize = next.FlushSize
+	cfg.FlushTime = next.FlushTime
+	cfg.FlushBytes = next.FlushBytes
+	cfg.FlushPolicies = next.FlushPolicies
+	cfg.WriteValidation = next.WriteValidation
+	cfg.MaxBodySize = next.MaxBodySize
+	cfg.MaxLineSize = next.MaxLineSize
+	cfg.OverflowStatus = next.OverflowStatus
+	cfg.RetryAfter = next.RetryAfter
+	cfg.PromMeasurement = next.PromMeasurement
+	cfg.OTLP = next.OTLP
+
+	backends := make(map[string]*BackendConfig)
+	for _, circle := range next.Circles {
+		for _, bkcfg := range circle.Backends {
+			backends[bkcfg.Name] = bkcfg
+		}
+	}
+	cfg.Circles = make([]*CircleConfig, len(cur.Circles))
+	for i, circle := range cur.Circles {
+		circfg := *circle
+		circfg.Backends = make([]*BackendConfig, len(circle.Backends))
+		for j, bkcfg := range circle.Backends {
+			b := *bkcfg
+			if nb, ok := backends[b.Name]; ok && nb.Url == b.Url {
+				b.Username, b.Password, b.AuthEncrypt = nb.Username, nb.Password, nb.AuthEncrypt
+			}
+			circfg.Backends[j] = &b
+		}
+		cfg.Circles[i] = &circfg
+	}
+	return &cfg
+}
+
+// diffCircles describes the changes of the circles, backends and hash_key, which alter the routing of the points
+func diffCircles(cur, next *ProxyConfig) (changes []string) {
+	if cur.HashKey != next.HashKey {
+		changes = append(changes, fmt.Sprintf("hash_key %s -> %s", cur.HashKey, next.HashKey))
+	}
+	if len(cur.Circles) != len(next.Circles) {
+		return append(changes, fmt.Sprintf("%d circles -> %d circles", len(cur.Circles), len(next.Circles)))
+	}
+	for i, circle := range cur.Circles {
+		ncircle := next.Circles[i]
+		if circle.Name != ncircle.Name {
+			changes = append(changes, fmt.Sprintf("circle %d name %s -> %s", i, circle.Name, ncircle.Name))
+		}
+		if len(circle.Backends) != len(ncircle.Backends) {
+			changes = append(changes, fmt.Sprintf("circle %d: %d backends -> %d backends", i, len(circle.Backends), len(ncircle.Backends)))
+			continue
+		}
+		for j, bkcfg := range circle.Backends {
+			nbkcfg := ncircle.Backends[j]
+			if bkcfg.Name != nbkcfg.Name || bkcfg.Url != nbkcfg.Url {
+				changes = append(changes, fmt.Sprintf("circle %d backend %d: %s %s -> %s %s", i, j, bkcfg.Name, bkcfg.Url, nbkcfg.Name, nbkcfg.Url))
+			}
+		}
+	}
+	return
+}
+
+// diffKeys returns the keys of the fields which differ between the configs
+func diffKeys(a, b *ProxyConfig) (keys []string) {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		key := field.Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const reloadConfig = `{
+  "circles": [{"name": "circle-1", "backends": [{"name": "influxdb-1", "url": "%s", "password": "%s"}]}],
+  "data_dir": "%s",
+  "listen_addr": "%s",
+  "db_list": ["%s"],
+  "flush_time": %d
+}`
+
+func TestProxyReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "proxy.json")
+	writeConfig := func(url, password, listenAddr, db string, flushTime int) {
+		content := fmt.Sprintf(reloadConfig, url, password, dir, listenAddr, db, flushTime)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("http://127.0.0.1:8086", "", ":7076", "db1", 1)
+	cfg, err := NewFileConfig(file)
+	if err != nil {
+		t.Fatalf("new config error: %s", err)
+	}
+	ip := NewProxy(cfg)
+	defer ip.Close(context.Background())
+	be := ip.Circles[0].Backends[0]
+
+	writeConfig("http://127.0.0.1:8086", "secret", ":7077", "db2", 5)
+	if _, err = ip.Reload(false); err != nil {
+		t.Fatalf("reload error: %s", err)
+	}
+	if ip.AllowDatabase("db1") || !ip.AllowDatabase("db2") {
+		t.Error("expect db_list reloaded")
+	}
+	if fp := be.getFlushPolicies().Default(); fp.Time != 5*time.Second {
+		t.Errorf("expect flush_time reloaded, got %v", fp.Time)
+	}
+	if auth := be.auth.Load().(*basicAuth); auth.password != "secret" {
+		t.Errorf("expect backend password reloaded, got %q", auth.password)
+	}
+	// listen_addr takes effect after restart
+	if ip.Config().ListenAddr != ":7076" {
+		t.Errorf("expect listen_addr unchanged, got %s", ip.Config().ListenAddr)
+	}
+
+	writeConfig("http://127.0.0.1:8087", "secret", ":7076", "db3", 5)
+	if _, err = ip.Reload(false); !errors.Is(err, ErrCirclesChanged) {
+		t.Fatalf("expect ErrCirclesChanged, got %v", err)
+	}
+	if ip.AllowDatabase("db3") {
+		t.Error("expect the refused reload not applied")
+	}
+	if _, err = ip.Reload(true); err != nil {
+		t.Fatalf("forced reload error: %s", err)
+	}
+	if !ip.AllowDatabase("db3") || ip.Config().Circles[0].Backends[0].Url != "http://127.0.0.1:8086" {
+		t.Error("expect the forced reload to apply db_list but not the circles")
+	}
+}
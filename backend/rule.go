@@ -0,0 +1,292 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+// ParsedLine is a line protocol point split into unescaped keys and raw values
+type ParsedLine struct {
+	Measurement string
+	Tags        [][2]string
+	Fields      [][2]string
+	Time        []byte
+}
+
+// scanUntil returns the index of the first unescaped byte in stops outside the string field values
+func scanUntil(buf []byte, i int, stops string, quoted bool) int {
+	inQuote := false
+	for ; i < len(buf); i++ {
+		c := buf[i]
+		if c == '\\' {
+			i++
+			continue
+		}
+		if quoted && c == '"' {
+			inQuote = !inQuote
+			continue
+		}
+		if !inQuote && strings.IndexByte(stops, c) != -1 {
+			return i
+		}
+	}
+	return len(buf)
+}
+
+func ParseLine(line []byte) (pl *ParsedLine, err error) {
+	line = bytes.TrimSpace(line)
+	pl = &ParsedLine{}
+	i := scanUntil(line, 0, ", ", false)
+	pl.Measurement = util.UnescapeMeasurement(string(line[:i]))
+	for i < len(line) && line[i] == ',' {
+		start := i + 1
+		i = scanUntil(line, start, ", ", false)
+		eq := scanUntil(line[:i], start, "=", false)
+		if eq >= i {
+			return nil, ErrMissingTagValue
+		}
+		pl.Tags = append(pl.Tags, [2]string{util.UnescapeTag(string(line[start:eq])), util.UnescapeTag(string(line[eq+1 : i]))})
+	}
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	for i < len(line) {
+		start := i
+		i = scanUntil(line, start, ", ", true)
+		eq := scanUntil(line[:i], start, "=", false)
+		if eq >= i {
+			return nil, ErrInvalidFormat
+		}
+		pl.Fields = append(pl.Fields, [2]string{util.UnescapeTag(string(line[start:eq])), string(line[eq+1 : i])})
+		if i >= len(line) || line[i] == ' ' {
+			break
+		}
+		i++
+	}
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	if i < len(line) {
+		pl.Time = line[i:]
+	}
+	if len(pl.Fields) == 0 {
+		return nil, ErrMissingFields
+	}
+	return
+}
+
+func (pl *ParsedLine) Bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(util.EscapeMeasurement(pl.Measurement))
+	for _, tag := range pl.Tags {
+		b.WriteByte(',')
+		b.WriteString(util.EscapeTag(tag[0]))
+		b.WriteByte('=')
+		b.WriteString(util.EscapeTag(tag[1]))
+	}
+	for i, field := range pl.Fields {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(util.EscapeTag(field[0]))
+		b.WriteByte('=')
+		b.WriteString(field[1])
+	}
+	if len(pl.Time) > 0 {
+		b.WriteByte(' ')
+		b.Write(pl.Time)
+	}
+	return b.Bytes()
+}
+
+// WriteRule transforms the points of the database and measurement on the write path
+type WriteRule struct {
+	dropped           int64 // keep first for 64-bit alignment of atomic operations
+	database          string
+	measurement       *regexp.Regexp
+	renameMeasurement string
+	addTags           [][2]string
+	dropTags          util.Set
+	renameTags        map[string]string
+	dropFields        util.Set
+	renameFields      map[string]string
+	lowercase         bool
+}
+
+type WriteRuleStats struct {
+	Database    string `json:"database"`
+	Measurement string `json:"measurement"`
+	Dropped     int64  `json:"dropped"`
+}
+
+// parsePairs parses "from=to" pairs, the map style is avoided since viper lowercases the map keys
+func parsePairs(pairs []string) ([][2]string, error) {
+	res := make([][2]string, 0, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid pair %q, require key=value", pair)
+		}
+		res = append(res, [2]string{kv[0], kv[1]})
+	}
+	return res, nil
+}
+
+func pairsToMap(pairs [][2]string) map[string]string {
+	m := make(map[string]string, len(pairs))
+	for _, kv := range pairs {
+		m[kv[0]] = kv[1]
+	}
+	return m
+}
+
+func NewWriteRule(cfg *WriteRuleConfig) (wr *WriteRule, err error) {
+	wr = &WriteRule{
+		database:          cfg.Database,
+		renameMeasurement: cfg.RenameMeasurement,
+		dropTags:          util.NewSetFromSlice(cfg.DropTags),
+		dropFields:        util.NewSetFromSlice(cfg.DropFields),
+		lowercase:         cfg.Lowercase,
+	}
+	if cfg.Measurement != "" {
+		wr.measurement, err = regexp.Compile(cfg.Measurement)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write_rules measurement: %s", err)
+		}
+	}
+	if cfg.RenameMeasurement != "" && wr.measurement == nil {
+		return nil, fmt.Errorf("invalid write_rules rename_measurement: require measurement regexp")
+	}
+	wr.addTags, err = parsePairs(cfg.AddTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid write_rules add_tags: %s", err)
+	}
+	renameTags, err := parsePairs(cfg.RenameTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid write_rules rename_tags: %s", err)
+	}
+	wr.renameTags = pairsToMap(renameTags)
+	renameFields, err := parsePairs(cfg.RenameFields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid write_rules rename_fields: %s", err)
+	}
+	wr.renameFields = pairsToMap(renameFields)
+	return
+}
+
+func NewWriteRules(cfgs []*WriteRuleConfig) (rules []*WriteRule, err error) {
+	for _, cfg := range cfgs {
+		wr, err := NewWriteRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, wr)
+	}
+	return
+}
+
+func (wr *WriteRule) Match(db, meas string) bool {
+	return (wr.database == "" || wr.database == db) && (wr.measurement == nil || wr.measurement.MatchString(meas))
+}
+
+func (wr *WriteRule) Stats() *WriteRuleStats {
+	stats := &WriteRuleStats{
+		Database: wr.database,
+		Dropped:  atomic.LoadInt64(&wr.dropped),
+	}
+	if wr.measurement != nil {
+		stats.Measurement = wr.measurement.String()
+	}
+	return stats
+}
+
+func (wr *WriteRule) Apply(pl *ParsedLine) {
+	if wr.renameMeasurement != "" {
+		pl.Measurement = wr.measurement.ReplaceAllString(pl.Measurement, wr.renameMeasurement)
+	}
+	tags := pl.Tags[:0]
+	for _, tag := range pl.Tags {
+		if wr.dropTags[tag[0]] {
+			continue
+		}
+		if key, ok := wr.renameTags[tag[0]]; ok {
+			tag[0] = key
+		}
+		tags = append(tags, tag)
+	}
+	pl.Tags = tags
+	for _, add := range wr.addTags {
+		found := false
+		for i := range pl.Tags {
+			if pl.Tags[i][0] == add[0] {
+				pl.Tags[i][1] = add[1]
+				found = true
+				break
+			}
+		}
+		if !found {
+			pl.Tags = append(pl.Tags, add)
+		}
+	}
+	fields := pl.Fields[:0]
+	for _, field := range pl.Fields {
+		if wr.dropFields[field[0]] {
+			continue
+		}
+		if key, ok := wr.renameFields[field[0]]; ok {
+			field[0] = key
+		}
+		fields = append(fields, field)
+	}
+	pl.Fields = fields
+	if wr.lowercase {
+		pl.Measurement = strings.ToLower(pl.Measurement)
+		for i := range pl.Tags {
+			pl.Tags[i][0] = strings.ToLower(pl.Tags[i][0])
+		}
+		for i := range pl.Fields {
+			pl.Fields[i][0] = strings.ToLower(pl.Fields[i][0])
+		}
+	}
+}
+
+// ApplyWriteRules transforms the line by the matched rules in order,
+// it returns nil if all the fields of the line are dropped, which is counted by the dropping rule
+func ApplyWriteRules(rules []*WriteRule, db string, meas string, line []byte) ([]byte, error) {
+	var pl *ParsedLine
+	for _, wr := range rules {
+		if pl != nil {
+			meas = pl.Measurement
+		}
+		if !wr.Match(db, meas) {
+			continue
+		}
+		if pl == nil {
+			var err error
+			pl, err = ParseLine(line)
+			if err != nil {
+				return nil, err
+			}
+		}
+		wr.Apply(pl)
+		if len(pl.Fields) == 0 {
+			atomic.AddInt64(&wr.dropped, 1)
+			return nil, nil
+		}
+	}
+	if pl == nil {
+		return line, nil
+	}
+	return pl.Bytes(), nil
+}
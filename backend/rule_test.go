@@ -0,0 +1,145 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "test1",
+			line: "cpu,host=server01,region=us value=1 1596819659",
+			want: "cpu,host=server01,region=us value=1 1596819659",
+		},
+		{
+			name: "test2",
+			line: "cpu value=1i",
+			want: "cpu value=1i",
+		},
+		{
+			name: "test3",
+			line: `cpu\ load,host\ name=server\,01 value\=x="a, b=c d",v=2 1596819659`,
+			want: `cpu\ load,host\ name=server\,01 value\=x="a, b=c d",v=2 1596819659`,
+		},
+		{
+			name: "test4",
+			line: `cpu msg="say \"hi\"" 1596819659`,
+			want: `cpu msg="say \"hi\"" 1596819659`,
+		},
+	}
+	for _, tt := range tests {
+		pl, err := ParseLine([]byte(tt.line))
+		if err != nil {
+			t.Errorf("%v: ParseLine error: %s", tt.name, err)
+			continue
+		}
+		if got := string(pl.Bytes()); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if _, err := ParseLine([]byte("cpu,host=server01 1596819659")); err == nil {
+		t.Error("ParseLine should fail on missing fields")
+	}
+	if _, err := ParseLine([]byte("cpu,host value=1")); err != ErrMissingTagValue {
+		t.Errorf("ParseLine error: got %v, want %v", err, ErrMissingTagValue)
+	}
+}
+
+func TestApplyWriteRules(t *testing.T) {
+	cfgs := []*WriteRuleConfig{
+		{
+			Database:          "db1",
+			Measurement:       `^app_(\w+)$`,
+			RenameMeasurement: "${1}",
+			AddTags:           []string{"dc=sh1"},
+			DropTags:          []string{"pid"},
+			RenameTags:        []string{"hostName=host"},
+		},
+		{
+			DropFields:   []string{"debug"},
+			RenameFields: []string{"val=value"},
+		},
+		{
+			Database:  "db2",
+			Lowercase: true,
+		},
+	}
+	rules, err := NewWriteRules(cfgs)
+	if err != nil {
+		t.Fatalf("NewWriteRules error: %s", err)
+	}
+	tests := []struct {
+		name string
+		db   string
+		line string
+		want string
+	}{
+		{
+			name: "rename",
+			db:   "db1",
+			line: "app_cpu,hostName=server01,pid=12 val=1,debug=2 1596819659",
+			want: "cpu,host=server01,dc=sh1 value=1 1596819659",
+		},
+		{
+			name: "override",
+			db:   "db1",
+			line: "app_cpu,dc=bj val=1 1596819659",
+			want: "cpu,dc=sh1 value=1 1596819659",
+		},
+		{
+			name: "unmatched",
+			db:   "db1",
+			line: "cpu,pid=12 value=1 1596819659",
+			want: "cpu,pid=12 value=1 1596819659",
+		},
+		{
+			name: "lowercase",
+			db:   "db2",
+			line: "CPU,Host=Server01 Value=1 1596819659",
+			want: "cpu,host=Server01 value=1 1596819659",
+		},
+		{
+			name: "dropped",
+			db:   "db2",
+			line: "cpu debug=1 1596819659",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		line := []byte(tt.line)
+		meas, _ := ScanKey(line)
+		got, err := ApplyWriteRules(rules, tt.db, meas, line)
+		if err != nil {
+			t.Errorf("%v: ApplyWriteRules error: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if dropped := rules[1].Stats().Dropped; dropped != 1 {
+		t.Errorf("dropped: got %d, want 1", dropped)
+	}
+}
+
+func TestNewWriteRule(t *testing.T) {
+	invalids := []*WriteRuleConfig{
+		{Measurement: "(cpu"},
+		{RenameMeasurement: "cpu"},
+		{AddTags: []string{"dc"}},
+		{RenameFields: []string{"=value"}},
+	}
+	for i, cfg := range invalids {
+		if _, err := NewWriteRule(cfg); err == nil {
+			t.Errorf("invalid rule %d: expect error", i)
+		}
+	}
+}
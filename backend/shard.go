@@ -0,0 +1,606 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var (
+	ErrShardedFunction = errors.New("unsupported function on sharded measurement, only sum, count, min, max and mean are supported")
+	ErrShardedClause   = errors.New("unsupported clause on sharded measurement, offset, slimit, soffset and subquery are not supported")
+	ErrShardedFill     = errors.New("unsupported fill on sharded measurement, only null, none or number is supported")
+)
+
+var (
+	reFunction = regexp.MustCompile(`(?i)^([a-z_]+)\s*\((.*)\)$`)
+	reFill     = regexp.MustCompile(`(?i)\bfill\s*\(\s*([^)]*?)\s*\)`)
+	reLimit    = regexp.MustCompile(`(?i)\blimit\s+(\d+)`)
+	reUnsafe   = regexp.MustCompile(`(?i)(\boffset\s+\d+|\bslimit\s+\d+|\bsoffset\s+\d+|^\s*\(\s*select\b)`)
+	reGroupBy  = regexp.MustCompile(`(?i)\bgroup\s+by\b.*\btime\s*\(`)
+	reDesc     = regexp.MustCompile(`(?i)\border\s+by\s+time\s+desc\b`)
+)
+
+// ShardRules holds the tags to shard a measurement across the backends of a circle
+type ShardRules struct {
+	tags map[string][]string
+}
+
+func NewShardRules(cfgs []*ShardRuleConfig) (sr *ShardRules) {
+	sr = &ShardRules{tags: make(map[string][]string)}
+	for _, cfg := range cfgs {
+		sr.tags[GetKey(cfg.Database, cfg.Measurement)] = cfg.Tags
+	}
+	return
+}
+
+// Tags returns the shard tags of the measurement, the rule with database takes precedence
+func (sr *ShardRules) Tags(db, meas string) []string {
+	if len(sr.tags) == 0 {
+		return nil
+	}
+	if tags, ok := sr.tags[GetKey(db, meas)]; ok {
+		return tags
+	}
+	return sr.tags[GetKey("", meas)]
+}
+
+func (sr *ShardRules) IsSharded(db, meas string) bool {
+	return len(sr.Tags(db, meas)) > 0
+}
+
+// GetShardKey appends the values of the shard tags in line to the key
+func GetShardKey(key string, line []byte, tags []string) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, tag := range tags {
+		b.WriteByte(',')
+		b.WriteString(tag)
+		b.WriteByte('=')
+		b.Write(ScanTagValue(line, tag))
+	}
+	return b.String()
+}
+
+// ScanTagValue returns the escaped value of the tag in line, or nil if not found
+func ScanTagValue(line []byte, tag string) []byte {
+	buflen := len(line)
+	i := 0
+	// skip measurement
+	for ; i < buflen; i++ {
+		if line[i] == '\\' {
+			i++
+		} else if line[i] == ',' || line[i] == ' ' {
+			break
+		}
+	}
+	for i < buflen && line[i] == ',' {
+		i++
+		start, eq := i, -1
+		for ; i < buflen; i++ {
+			if line[i] == '\\' {
+				i++
+			} else if line[i] == '=' && eq == -1 {
+				eq = i
+			} else if line[i] == ',' || line[i] == ' ' {
+				break
+			}
+		}
+		if eq != -1 && util.UnescapeTag(string(line[start:eq])) == tag {
+			if i > buflen {
+				i = buflen
+			}
+			return line[eq+1 : i]
+		}
+	}
+	return nil
+}
+
+type shardField struct {
+	fn   string
+	arg  string
+	name string
+}
+
+type shardQuery struct {
+	fields    []*shardField
+	aggregate bool
+	groupBy   bool
+	desc      bool
+	limit     int
+	fill      interface{}
+	query     string
+}
+
+// SplitSelectQuery splits the select statement into field clause and the rest following from
+func SplitSelectQuery(q string) (fields string, rest string, err error) {
+	q = strings.TrimSpace(q)
+	if len(q) < 6 || !strings.EqualFold(q[:6], "select") {
+		return "", "", ErrIllegalQL
+	}
+	depth := 0
+	var quote byte
+	for i := 6; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == ' ' || c == '\t' || c == '\n') && i+5 < len(q) && strings.EqualFold(q[i+1:i+5], "from") && isFromEnd(q[i+5]):
+			return strings.TrimSpace(q[6:i]), strings.TrimSpace(q[i+5:]), nil
+		}
+	}
+	return "", "", ErrIllegalQL
+}
+
+func isFromEnd(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '('
+}
+
+// SplitFields splits the field clause by top-level commas
+func SplitFields(fields string) (items []string) {
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(fields); i++ {
+		c := fields[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, strings.TrimSpace(fields[start:i]))
+			start = i + 1
+		}
+	}
+	return append(items, strings.TrimSpace(fields[start:]))
+}
+
+func parseShardField(item string) (field *shardField) {
+	field = &shardField{}
+	expr := item
+	words := strings.Fields(item)
+	if len(words) >= 3 && strings.EqualFold(words[len(words)-2], "as") {
+		field.name = strings.Trim(words[len(words)-1], `"`)
+		idx := strings.LastIndex(strings.ToLower(item), " as ")
+		expr = strings.TrimSpace(item[:idx])
+	}
+	if m := reFunction.FindStringSubmatch(expr); m != nil {
+		field.fn = strings.ToLower(m[1])
+		field.arg = strings.TrimSpace(m[2])
+	} else {
+		field.arg = expr
+	}
+	return
+}
+
+// resolveNames names the output columns in the same way as InfluxDB
+func resolveNames(fields []*shardField) {
+	names := make(map[string]int)
+	for _, f := range fields {
+		if f.name != "" {
+			names[f.name] = 1
+		}
+	}
+	for _, f := range fields {
+		if f.name != "" {
+			continue
+		}
+		name := f.fn
+		count, conflict := names[name]
+		if conflict {
+			for {
+				resolved := fmt.Sprintf("%s_%d", name, count)
+				if _, conflict = names[resolved]; !conflict {
+					names[name] = count + 1
+					name = resolved
+					break
+				}
+				count++
+			}
+		}
+		names[name]++
+		f.name = name
+	}
+}
+
+// RewriteShardQuery rewrites the select statement into the one that each shard executes
+func RewriteShardQuery(q string) (sq *shardQuery, err error) {
+	fields, rest, err := SplitSelectQuery(q)
+	if err != nil {
+		return
+	}
+	if reUnsafe.MatchString(rest) {
+		return nil, ErrShardedClause
+	}
+	sq = &shardQuery{
+		groupBy: reGroupBy.MatchString(rest),
+		desc:    reDesc.MatchString(rest),
+	}
+	if m := reLimit.FindStringSubmatch(rest); m != nil {
+		sq.limit, _ = strconv.Atoi(m[1])
+	}
+	for _, item := range SplitFields(fields) {
+		field := parseShardField(item)
+		if field.fn != "" {
+			sq.aggregate = true
+		}
+		sq.fields = append(sq.fields, field)
+	}
+	if !sq.aggregate {
+		sq.query = q
+		return
+	}
+
+	parts := make([]string, 0, len(sq.fields))
+	for i, f := range sq.fields {
+		if f.arg == "" || f.arg == "*" || f.arg[0] == '/' || strings.Contains(f.arg, "(") {
+			return nil, ErrShardedFunction
+		}
+		switch f.fn {
+		case "sum", "count", "min", "max":
+			parts = append(parts, fmt.Sprintf("%s(%s) AS \"__f%d\"", f.fn, f.arg, i))
+		case "mean":
+			parts = append(parts, fmt.Sprintf("sum(%s) AS \"__s%d\", count(%s) AS \"__c%d\"", f.arg, i, f.arg, i))
+		default:
+			return nil, ErrShardedFunction
+		}
+	}
+	resolveNames(sq.fields)
+	if m := reFill.FindStringSubmatch(rest); m != nil {
+		switch strings.ToLower(m[1]) {
+		case "null", "none":
+		default:
+			if _, err := strconv.ParseFloat(m[1], 64); err != nil {
+				return nil, ErrShardedFill
+			}
+			sq.fill = normalizeValue(json.Number(m[1]))
+			rest = reFill.ReplaceAllString(rest, "fill(null)")
+		}
+	}
+	sq.query = fmt.Sprintf("SELECT %s FROM %s", strings.Join(parts, ", "), rest)
+	return
+}
+
+func normalizeValue(v interface{}) interface{} {
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+func addValue(a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	ai, aok := a.(int64)
+	bi, bok := b.(int64)
+	if aok && bok {
+		return ai + bi
+	}
+	return toFloat(a) + toFloat(b)
+}
+
+func timeToNano(v interface{}) int64 {
+	switch t := v.(type) {
+	case json.Number:
+		n, _ := t.Int64()
+		return n
+	case int64:
+		return t
+	case string:
+		tm, err := time.Parse(time.RFC3339Nano, t)
+		if err == nil {
+			return tm.UnixNano()
+		}
+	}
+	return 0
+}
+
+func seriesKey(row *models.Row) string {
+	keys := make([]string, 0, len(row.Tags))
+	for k := range row.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(row.Name)
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(row.Tags[k])
+	}
+	return b.String()
+}
+
+type shardBucket struct {
+	time   interface{}
+	nano   int64
+	values map[string]interface{}
+}
+
+type shardSeries struct {
+	row     *models.Row
+	buckets map[int64]*shardBucket
+	columns []string
+	values  [][]interface{}
+}
+
+// MergeShardSeries merges the series returned by the shards by series and time
+func MergeShardSeries(sq *shardQuery, rows [][]*models.Row) (series models.Rows) {
+	merged := make(map[string]*shardSeries)
+	var keys []string
+	for _, _rows := range rows {
+		for _, row := range _rows {
+			key := seriesKey(row)
+			ss, ok := merged[key]
+			if !ok {
+				ss = &shardSeries{row: row, buckets: make(map[int64]*shardBucket)}
+				merged[key] = ss
+				keys = append(keys, key)
+			}
+			if sq.aggregate {
+				sq.mergeAggregate(ss, row)
+			} else {
+				sq.mergeRaw(ss, row)
+			}
+		}
+	}
+	for _, key := range keys {
+		ss := merged[key]
+		row := &models.Row{Name: ss.row.Name, Tags: ss.row.Tags}
+		if sq.aggregate {
+			row.Columns, row.Values = sq.aggregateValues(ss)
+		} else {
+			row.Columns, row.Values = ss.columns, ss.values
+		}
+		sort.SliceStable(row.Values, func(i, j int) bool {
+			ti, tj := timeToNano(row.Values[i][0]), timeToNano(row.Values[j][0])
+			if sq.desc {
+				return ti > tj
+			}
+			return ti < tj
+		})
+		if sq.limit > 0 && len(row.Values) > sq.limit {
+			row.Values = row.Values[:sq.limit]
+		}
+		series = append(series, row)
+	}
+	return
+}
+
+func (sq *shardQuery) mergeRaw(ss *shardSeries, row *models.Row) {
+	index := make([]int, len(row.Columns))
+	for i, col := range row.Columns {
+		index[i] = -1
+		for j, c := range ss.columns {
+			if c == col {
+				index[i] = j
+				break
+			}
+		}
+		if index[i] == -1 {
+			ss.columns = append(ss.columns, col)
+			index[i] = len(ss.columns) - 1
+			for k := range ss.values {
+				ss.values[k] = append(ss.values[k], nil)
+			}
+		}
+	}
+	for _, value := range row.Values {
+		v := make([]interface{}, len(ss.columns))
+		for i := range value {
+			v[index[i]] = value[i]
+		}
+		ss.values = append(ss.values, v)
+	}
+}
+
+func (sq *shardQuery) mergeAggregate(ss *shardSeries, row *models.Row) {
+	// a single selector without group by time returns the time of the selected point
+	selector := len(sq.fields) == 1 && (sq.fields[0].fn == "min" || sq.fields[0].fn == "max")
+	for _, value := range row.Values {
+		nano := timeToNano(value[0])
+		key := nano
+		if !sq.groupBy {
+			key = 0
+		}
+		b, ok := ss.buckets[key]
+		if !ok {
+			b = &shardBucket{time: value[0], nano: nano, values: make(map[string]interface{})}
+			ss.buckets[key] = b
+		}
+		for i := 1; i < len(value) && i < len(row.Columns); i++ {
+			col := row.Columns[i]
+			v := normalizeValue(value[i])
+			if v == nil {
+				continue
+			}
+			old := b.values[col]
+			switch {
+			case strings.HasPrefix(col, "__s"), strings.HasPrefix(col, "__c"):
+				b.values[col] = addValue(old, v)
+			case strings.HasPrefix(col, "__f"):
+				idx, _ := strconv.Atoi(col[3:])
+				if idx >= len(sq.fields) {
+					continue
+				}
+				switch sq.fields[idx].fn {
+				case "sum", "count":
+					b.values[col] = addValue(old, v)
+				case "min", "max":
+					if old == nil || (sq.fields[idx].fn == "min" && toFloat(v) < toFloat(old)) || (sq.fields[idx].fn == "max" && toFloat(v) > toFloat(old)) {
+						b.values[col] = v
+						if selector && !sq.groupBy {
+							b.time, b.nano = value[0], nano
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func (sq *shardQuery) aggregateValues(ss *shardSeries) (columns []string, values [][]interface{}) {
+	columns = make([]string, len(sq.fields)+1)
+	columns[0] = "time"
+	for i, f := range sq.fields {
+		columns[i+1] = f.name
+	}
+	for _, b := range ss.buckets {
+		value := make([]interface{}, len(sq.fields)+1)
+		value[0] = b.time
+		for i, f := range sq.fields {
+			var v interface{}
+			if f.fn == "mean" {
+				sum, count := b.values[fmt.Sprintf("__s%d", i)], b.values[fmt.Sprintf("__c%d", i)]
+				if sum != nil && count != nil && toFloat(count) > 0 {
+					v = toFloat(sum) / toFloat(count)
+				}
+			} else {
+				v = b.values[fmt.Sprintf("__f%d", i)]
+			}
+			if v == nil {
+				v = sq.fill
+			}
+			value[i+1] = v
+		}
+		values = append(values, value)
+	}
+	return
+}
+
+// MergeShowSeries merges the series of show statements with the union of values
+func MergeShowSeries(rows [][]*models.Row) (series models.Rows) {
+	merged := make(map[string]*models.Row)
+	seen := make(map[string]util.Set)
+	var keys []string
+	for _, _rows := range rows {
+		for _, row := range _rows {
+			key := seriesKey(row)
+			if _, ok := merged[key]; !ok {
+				merged[key] = &models.Row{Name: row.Name, Tags: row.Tags, Columns: row.Columns}
+				seen[key] = util.NewSet()
+				keys = append(keys, key)
+			}
+			for _, value := range row.Values {
+				vk := fmt.Sprint(value)
+				if !seen[key][vk] {
+					seen[key].Add(vk)
+					merged[key].Values = append(merged[key].Values, value)
+				}
+			}
+		}
+	}
+	for _, key := range keys {
+		series = append(series, merged[key])
+	}
+	return
+}
+
+func (ip *Proxy) GetShardCircle() *Circle {
+	// pass non-active, and try rewriting or write-only at last.
+	circles := ip.queryCircles(func(circle *Circle) []*Backend {
+		return circle.Backends
+	})
+	if len(circles) == 0 {
+		return nil
+	}
+	return circles[0]
+}
+
+func QueryShardedQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
+	// one circle -> all backends -> select or show -> merge
+	circle := ip.GetShardCircle()
+	if circle == nil {
+		return nil, ErrBackendsUnavailable
+	}
+	var sq *shardQuery
+	if strings.ToLower(tokens[0]) == "select" {
+		sq, err = RewriteShardQuery(strings.TrimSpace(req.FormValue("q")))
+		if err != nil {
+			return
+		}
+		req.Form.Set("q", sq.query)
+	}
+	req.Form.Del("chunked")
+	bodies, _, err := QueryInParallel(circle.Backends, req, w, true)
+	if err != nil {
+		return
+	}
+	rows := make([][]*models.Row, 0, len(bodies))
+	for _, b := range bodies {
+		results, err := ResultsFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) > 0 {
+			if results[0].Err != "" {
+				return nil, errors.New(results[0].Err)
+			}
+			rows = append(rows, results[0].Series)
+		}
+	}
+
+	var series models.Rows
+	if sq != nil {
+		series = MergeShardSeries(sq, rows)
+	} else {
+		series = MergeShowSeries(rows)
+	}
+	pretty := req.URL.Query().Get("pretty") == "true"
+	body = util.MarshalJSON(ResponseFromSeries(series), pretty)
+	if w != nil && w.Header().Get("Content-Encoding") == "gzip" {
+		return util.GzipCompress(body)
+	}
+	return
+}
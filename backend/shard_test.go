@@ -0,0 +1,207 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestScanTagValue(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		tag  string
+		want string
+	}{
+		{
+			name: "test1",
+			line: "cpu,host=server01,region=us value=1 1596819659",
+			tag:  "host",
+			want: "server01",
+		},
+		{
+			name: "test2",
+			line: "cpu,host=server01,region=us value=1 1596819659",
+			tag:  "region",
+			want: "us",
+		},
+		{
+			name: "test3",
+			line: "cpu value=1,host=server01 1596819659",
+			tag:  "host",
+			want: "",
+		},
+		{
+			name: "test4",
+			line: "cpu\\,1,tag\\ key=a\\ b\\,c,host=x value=1",
+			tag:  "tag key",
+			want: "a\\ b\\,c",
+		},
+		{
+			name: "test5",
+			line: "cpu,hostname=a,host=b value=1",
+			tag:  "host",
+			want: "b",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(ScanTagValue([]byte(tt.line), tt.tag)); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShardRules(t *testing.T) {
+	sr := NewShardRules([]*ShardRuleConfig{
+		{Measurement: "cpu", Tags: []string{"host"}},
+		{Database: "db1", Measurement: "cpu", Tags: []string{"host", "region"}},
+	})
+	if got := sr.Tags("db1", "cpu"); !reflect.DeepEqual(got, []string{"host", "region"}) {
+		t.Errorf("got %v", got)
+	}
+	if got := sr.Tags("db2", "cpu"); !reflect.DeepEqual(got, []string{"host"}) {
+		t.Errorf("got %v", got)
+	}
+	if sr.IsSharded("db1", "mem") {
+		t.Errorf("mem should not be sharded")
+	}
+	key := GetShardKey(GetKey("db1", "cpu"), []byte("cpu,region=us,host=a value=1"), sr.Tags("db1", "cpu"))
+	if key != "db1,cpu,host=a,region=us" {
+		t.Errorf("got %v", key)
+	}
+}
+
+func TestRewriteShardQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		q     string
+		want  string
+		names []string
+		err   error
+	}{
+		{
+			name: "raw",
+			q:    "select * from cpu where host = 'a'",
+			want: "select * from cpu where host = 'a'",
+		},
+		{
+			name:  "aggregate",
+			q:     "SELECT mean(\"value\"), max(value) AS m, sum(value), mean(idle) FROM \"cpu\" WHERE time > now() - 1h GROUP BY time(1m) fill(0)",
+			want:  "SELECT sum(\"value\") AS \"__s0\", count(\"value\") AS \"__c0\", max(value) AS \"__f1\", sum(value) AS \"__f2\", sum(idle) AS \"__s3\", count(idle) AS \"__c3\" FROM \"cpu\" WHERE time > now() - 1h GROUP BY time(1m) fill(null)",
+			names: []string{"mean", "m", "sum", "mean_1"},
+		},
+		{
+			name: "function",
+			q:    "select percentile(value, 95) from cpu",
+			err:  ErrShardedFunction,
+		},
+		{
+			name: "wildcard",
+			q:    "select count(*) from cpu",
+			err:  ErrShardedFunction,
+		},
+		{
+			name: "offset",
+			q:    "select value from cpu limit 10 offset 10",
+			err:  ErrShardedClause,
+		},
+		{
+			name: "subquery",
+			q:    "select max(m) from (select mean(value) as m from cpu group by time(1m))",
+			err:  ErrShardedClause,
+		},
+		{
+			name: "fill",
+			q:    "select sum(value) from cpu group by time(1m) fill(previous)",
+			err:  ErrShardedFill,
+		},
+	}
+	for _, tt := range tests {
+		sq, err := RewriteShardQuery(tt.q)
+		if err != tt.err {
+			t.Errorf("%v: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if sq.query != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, sq.query, tt.want)
+		}
+		if tt.names != nil {
+			names := make([]string, len(sq.fields))
+			for i, f := range sq.fields {
+				names[i] = f.name
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("%v: got names %v, want %v", tt.name, names, tt.names)
+			}
+		}
+	}
+}
+
+func TestMergeShardSeries(t *testing.T) {
+	sq, err := RewriteShardQuery("select mean(value), sum(value), max(value), count(value) from cpu group by time(1m) fill(0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := []string{"time", "__s0", "__c0", "__f1", "__f2", "__f3"}
+	rows := [][]*models.Row{
+		{{Name: "cpu", Columns: columns, Values: [][]interface{}{
+			{json.Number("60"), json.Number("6"), json.Number("2"), json.Number("6"), json.Number("5"), json.Number("2")},
+			{json.Number("0"), json.Number("1.5"), json.Number("1"), json.Number("1.5"), json.Number("1.5"), json.Number("1")},
+		}}},
+		{{Name: "cpu", Columns: columns, Values: [][]interface{}{
+			{json.Number("0"), json.Number("4"), json.Number("2"), json.Number("4"), json.Number("3"), json.Number("2")},
+			{json.Number("60"), nil, nil, nil, nil, nil},
+			{json.Number("120"), nil, nil, nil, nil, nil},
+		}}},
+	}
+	series := MergeShardSeries(sq, rows)
+	want := models.Rows{{
+		Name:    "cpu",
+		Columns: []string{"time", "mean", "sum", "max", "count"},
+		Values: [][]interface{}{
+			{json.Number("0"), 5.5 / 3, 5.5, int64(3), int64(3)},
+			{json.Number("60"), float64(3), int64(6), int64(5), int64(2)},
+			{json.Number("120"), int64(0), int64(0), int64(0), int64(0)},
+		},
+	}}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("got %+v, want %+v", series[0], want[0])
+	}
+}
+
+func TestMergeShardSeriesRaw(t *testing.T) {
+	sq, err := RewriteShardQuery("select * from cpu order by time desc limit 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]*models.Row{
+		{{Name: "cpu", Columns: []string{"time", "host", "value"}, Values: [][]interface{}{
+			{"2021-01-01T00:00:00Z", "a", json.Number("1")},
+			{"2021-01-01T00:00:02Z", "a", json.Number("3")},
+		}}},
+		{{Name: "cpu", Columns: []string{"time", "host", "idle"}, Values: [][]interface{}{
+			{"2021-01-01T00:00:01.5Z", "b", json.Number("2")},
+		}}},
+	}
+	series := MergeShardSeries(sq, rows)
+	want := models.Rows{{
+		Name:    "cpu",
+		Columns: []string{"time", "host", "value", "idle"},
+		Values: [][]interface{}{
+			{"2021-01-01T00:00:02Z", "a", json.Number("3"), nil},
+			{"2021-01-01T00:00:01.5Z", "b", nil, json.Number("2")},
+		},
+	}}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("got %+v, want %+v", series[0], want[0])
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const (
+	StatsdCounter = "c"
+	StatsdGauge   = "g"
+	StatsdTimer   = "ms"
+	StatsdSet     = "s"
+)
+
+var (
+	ErrStatsdInvalidLine = errors.New("invalid statsd line, require <name>:<value>|<type>[|@<rate>][|#<tags>]")
+	ErrStatsdInvalidType = errors.New("invalid statsd type, require c, g, ms, h, d or s")
+)
+
+var statsdMetricTypes = map[string]string{
+	StatsdCounter: "counter",
+	StatsdGauge:   "gauge",
+	StatsdTimer:   "timing",
+	StatsdSet:     "set",
+}
+
+// StatsdMetric is a metric of the line: <name>:<value>|<type>[|@<rate>][|#<tag1>:<value1>,<tag2>]
+type StatsdMetric struct {
+	Name  string
+	Value string
+	Type  string
+	Rate  float64
+	Tags  map[string]string
+}
+
+// ParseStatsd parses a statsd line with the dogstatsd tags, the histogram and distribution are treated as timer
+func ParseStatsd(line string) (*StatsdMetric, error) {
+	segs := strings.Split(line, "|")
+	if len(segs) < 2 {
+		return nil, ErrStatsdInvalidLine
+	}
+	i := strings.LastIndexByte(segs[0], ':')
+	if i <= 0 || i == len(segs[0])-1 {
+		return nil, ErrStatsdInvalidLine
+	}
+	m := &StatsdMetric{Name: segs[0][:i], Value: segs[0][i+1:], Type: segs[1], Rate: 1, Tags: make(map[string]string)}
+	switch m.Type {
+	case StatsdCounter, StatsdGauge, StatsdTimer, StatsdSet:
+	case "h", "d":
+		m.Type = StatsdTimer
+	default:
+		return nil, ErrStatsdInvalidType
+	}
+	for _, seg := range segs[2:] {
+		switch {
+		case strings.HasPrefix(seg, "@"):
+			rate, err := strconv.ParseFloat(seg[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid statsd sample rate %q", seg)
+			}
+			m.Rate = rate
+		case strings.HasPrefix(seg, "#"):
+			for _, tag := range strings.Split(seg[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 1 || kv[1] == "" {
+					// the tag without value
+					m.Tags[kv[0]] = "true"
+				} else {
+					m.Tags[kv[0]] = kv[1]
+				}
+			}
+		}
+	}
+	if m.Type != StatsdSet {
+		if _, err := strconv.ParseFloat(m.Value, 64); err != nil {
+			return nil, fmt.Errorf("invalid statsd value %q", m.Value)
+		}
+	}
+	return m, nil
+}
+
+// series returns the escaped measurement and tags, with the metric_type tag
+func (m *StatsdMetric) series() string {
+	keys := make([]string, 0, len(m.Tags)+1)
+	for k := range m.Tags {
+		if k != "metric_type" {
+			keys = append(keys, k)
+		}
+	}
+	keys = append(keys, "metric_type")
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(util.EscapeMeasurement(m.Name))
+	for _, k := range keys {
+		v := m.Tags[k]
+		if k == "metric_type" {
+			v = statsdMetricTypes[m.Type]
+		}
+		b.WriteByte(',')
+		b.WriteString(util.EscapeTag(k))
+		b.WriteByte('=')
+		b.WriteString(util.EscapeTag(v))
+	}
+	return b.String()
+}
+
+type statsdStat struct {
+	series string
+	typ    string
+	value  float64
+	count  float64
+	values []float64
+	set    map[string]struct{}
+}
+
+// StatsdAggregator aggregates the metrics by the series in a flush interval
+type StatsdAggregator struct {
+	percentiles []float64
+	stats       map[string]*statsdStat
+	lock        sync.Mutex
+}
+
+func NewStatsdAggregator(percentiles []float64) *StatsdAggregator {
+	return &StatsdAggregator{percentiles: percentiles, stats: make(map[string]*statsdStat)}
+}
+
+func (sa *StatsdAggregator) Add(m *StatsdMetric) {
+	series := m.series()
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	st, ok := sa.stats[series]
+	if !ok {
+		st = &statsdStat{series: series, typ: m.Type}
+		sa.stats[series] = st
+	}
+	switch m.Type {
+	case StatsdCounter:
+		v, _ := strconv.ParseFloat(m.Value, 64)
+		st.value += v / m.Rate
+	case StatsdGauge:
+		v, _ := strconv.ParseFloat(m.Value, 64)
+		if m.Value[0] == '+' || m.Value[0] == '-' {
+			st.value += v
+		} else {
+			st.value = v
+		}
+	case StatsdTimer:
+		v, _ := strconv.ParseFloat(m.Value, 64)
+		st.values = append(st.values, v)
+		st.count += 1 / m.Rate
+	case StatsdSet:
+		if st.set == nil {
+			st.set = make(map[string]struct{})
+		}
+		st.set[m.Value] = struct{}{}
+	}
+}
+
+// Flush returns one point for each series aggregated since the last flush, with ns precision
+func (sa *StatsdAggregator) Flush(now time.Time) (lines [][]byte) {
+	sa.lock.Lock()
+	stats := sa.stats
+	sa.stats = make(map[string]*statsdStat)
+	sa.lock.Unlock()
+
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	for _, st := range stats {
+		var fields [][2]string
+		switch st.typ {
+		case StatsdCounter, StatsdGauge:
+			fields = append(fields, [2]string{"value", formatStatsdFloat(st.value)})
+		case StatsdSet:
+			fields = append(fields, [2]string{"value", strconv.Itoa(len(st.set))})
+		case StatsdTimer:
+			fields = sa.timerFields(st)
+		}
+		var b strings.Builder
+		b.WriteString(st.series)
+		for i, field := range fields {
+			if i == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteByte(',')
+			}
+			b.WriteString(field[0])
+			b.WriteByte('=')
+			b.WriteString(field[1])
+		}
+		b.WriteByte(' ')
+		b.WriteString(ts)
+		lines = append(lines, []byte(b.String()))
+	}
+	return
+}
+
+func (sa *StatsdAggregator) timerFields(st *statsdStat) [][2]string {
+	values := st.values
+	sort.Float64s(values)
+	n := float64(len(values))
+	var sum, sq float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / n
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+	fields := [][2]string{
+		{"count", formatStatsdFloat(st.count)},
+		{"lower", formatStatsdFloat(values[0])},
+		{"mean", formatStatsdFloat(mean)},
+		{"stddev", formatStatsdFloat(math.Sqrt(sq / n))},
+		{"sum", formatStatsdFloat(sum)},
+		{"upper", formatStatsdFloat(values[len(values)-1])},
+	}
+	for _, p := range sa.percentiles {
+		// the nearest rank of the percentile
+		rank := int(math.Ceil(p / 100 * n))
+		if rank < 1 {
+			rank = 1
+		}
+		name := strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1) + "_percentile"
+		fields = append(fields, [2]string{name, formatStatsdFloat(values[rank-1])})
+	}
+	return fields
+}
+
+func formatStatsdFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
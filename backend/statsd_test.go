@@ -0,0 +1,87 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseStatsd(t *testing.T) {
+	m, err := ParseStatsd("api.requests:2|c|@0.5|#env:prod,canary")
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	if m.Name != "api.requests" || m.Value != "2" || m.Type != StatsdCounter || m.Rate != 0.5 ||
+		len(m.Tags) != 2 || m.Tags["env"] != "prod" || m.Tags["canary"] != "true" {
+		t.Errorf("got %+v", m)
+	}
+	if m, err = ParseStatsd("api.latency:12.5|h"); err != nil || m.Type != StatsdTimer {
+		t.Errorf("got %+v %v", m, err)
+	}
+
+	invalids := []string{
+		"api.requests",
+		"api.requests:1",
+		"api.requests:|c",
+		"api.requests:1|x",
+		"api.requests:abc|c",
+		"api.requests:1|c|@2",
+	}
+	for _, line := range invalids {
+		if _, err := ParseStatsd(line); err == nil {
+			t.Errorf("%s: expect error", line)
+		}
+	}
+}
+
+func TestStatsdAggregator(t *testing.T) {
+	sa := NewStatsdAggregator([]float64{50, 99.9})
+	lines := []string{
+		"requests:1|c|#host:web01",
+		"requests:2|c|@0.5|#host:web01",
+		"requests:1|c|#host:web02",
+		"temperature:20|g",
+		"temperature:+5|g",
+		"latency:10|ms",
+		"latency:30|ms",
+		"latency:20|ms",
+		"latency:40|ms",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+	}
+	for _, line := range lines {
+		m, err := ParseStatsd(line)
+		if err != nil {
+			t.Fatalf("%s: parse error: %s", line, err)
+		}
+		sa.Add(m)
+	}
+	got := make([]string, 0)
+	for _, line := range sa.Flush(time.Unix(1596819659, 0)) {
+		got = append(got, string(line))
+	}
+	sort.Strings(got)
+	want := []string{
+		"latency,metric_type=timing count=4,lower=10,mean=25,stddev=11.180339887498949,sum=100,upper=40,50_percentile=20,99_9_percentile=40 1596819659000000000",
+		"requests,host=web01,metric_type=counter value=5 1596819659000000000",
+		"requests,host=web02,metric_type=counter value=1 1596819659000000000",
+		"temperature,metric_type=gauge value=25 1596819659000000000",
+		"users,metric_type=set value=2 1596819659000000000",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines: %v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %s, want %s", got[i], want[i])
+		}
+	}
+	if lines := sa.Flush(time.Now()); len(lines) != 0 {
+		t.Errorf("expect empty after flush, got %d lines", len(lines))
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WALSegmentSize is the size to rotate the segment of the write-ahead log
+var WALSegmentSize int64 = 8 * 1024 * 1024
+
+// walHeaderSize is the max size of the escaped db, rp and precision ahead of the line in a record
+const walHeaderSize = 4096
+
+var ErrWALCorrupt = errors.New("wal record corrupt")
+
+type walSegment struct {
+	id      int
+	file    *os.File
+	size    int64
+	pending int
+}
+
+// WAL is the write-ahead log of the points held in the buffers of a backend,
+// a segment is truncated or removed once all its points have been flushed
+type WAL struct {
+	lock      sync.Mutex
+	filename  string
+	datadir   string
+	maxRecord uint32
+	current   *walSegment
+	replays   []string
+	dirty     bool
+}
+
+// NewWAL opens the write-ahead log, a record longer than the max line size plus the header is taken as corrupt on replay
+func NewWAL(filename string, datadir string, maxLineSize int) (wal *WAL, err error) {
+	wal = &WAL{
+		filename:  filename,
+		datadir:   datadir,
+		maxRecord: uint32(maxLineSize + walHeaderSize),
+	}
+	matches, err := filepath.Glob(filepath.Join(datadir, filename+".wal.*"))
+	if err != nil {
+		return
+	}
+	id := 0
+	for _, path := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Ext(path), "."))
+		if err != nil {
+			continue
+		}
+		wal.replays = append(wal.replays, path)
+		if n > id {
+			id = n
+		}
+	}
+	sort.Strings(wal.replays)
+	wal.current, err = wal.open(id + 1)
+	return
+}
+
+func (wal *WAL) path(id int) string {
+	return filepath.Join(wal.datadir, fmt.Sprintf("%s.wal.%08d", wal.filename, id))
+}
+
+func (wal *WAL) open(id int) (*walSegment, error) {
+	file, err := os.OpenFile(wal.path(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("open wal error: %s %s", wal.filename, err)
+		return nil, err
+	}
+	return &walSegment{id: id, file: file}, nil
+}
+
+// Append writes the point to the current segment, which is returned to be released by Done after flushed
+func (wal *WAL) Append(point *LinePoint) (seg *walSegment, err error) {
+	b := bytes.Join([][]byte{[]byte(url.QueryEscape(point.Db)), []byte(url.QueryEscape(point.Rp)), []byte(point.Precision), point.Line}, []byte{' '})
+	record := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(record, uint32(len(b)))
+	copy(record[4:], b)
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	seg = wal.current
+	if _, err = seg.file.Write(record); err != nil {
+		log.Printf("write wal error: %s %s", wal.filename, err)
+		return nil, err
+	}
+	seg.size += int64(len(record))
+	seg.pending++
+	wal.dirty = true
+	if seg.size >= WALSegmentSize {
+		// the rotated segment is synced and closed, and removed once its points are flushed
+		if next, err := wal.open(seg.id + 1); err == nil {
+			seg.file.Sync()
+			seg.file.Close()
+			wal.current = next
+			wal.dirty = false
+		}
+	}
+	return
+}
+
+// Done releases n points of the segment
+func (wal *WAL) Done(seg *walSegment, n int) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	seg.pending -= n
+	if seg.pending > 0 {
+		return
+	}
+	if seg == wal.current {
+		if err := seg.file.Truncate(0); err != nil {
+			log.Printf("truncate wal error: %s %s", wal.filename, err)
+			return
+		}
+		seg.size = 0
+		wal.dirty = false
+	} else if err := os.Remove(wal.path(seg.id)); err != nil {
+		log.Printf("remove wal error: %s %s", wal.filename, err)
+	}
+}
+
+// Sync commits the current segment to the disk
+func (wal *WAL) Sync() (err error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if !wal.dirty {
+		return
+	}
+	err = wal.current.file.Sync()
+	if err != nil {
+		log.Printf("sync wal error: %s %s", wal.filename, err)
+		return
+	}
+	wal.dirty = false
+	return
+}
+
+// Replay reads the segments left by the last run and hands over the lines grouped by db, rp and precision,
+// each segment is removed after all its lines are handed over, and the records from the incomplete or corrupt one are ignored
+func (wal *WAL) Replay(fn func(db, rp, precision string, p []byte) error) (err error) {
+	for _, path := range wal.replays {
+		if err = wal.replay(path, fn); err != nil {
+			log.Printf("replay wal error: %s %s", path, err)
+			return
+		}
+		if err = os.Remove(path); err != nil {
+			log.Printf("remove wal error: %s %s", path, err)
+			return
+		}
+	}
+	wal.replays = nil
+	return
+}
+
+func (wal *WAL) replay(path string, fn func(db, rp, precision string, p []byte) error) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	type group struct {
+		db, rp, precision string
+		buf               bytes.Buffer
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	r := bufio.NewReader(file)
+	var length uint32
+	count := 0
+	for {
+		if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+			break
+		}
+		if length > wal.maxRecord {
+			err = ErrWALCorrupt
+			log.Printf("replay wal: %s, %s at %d points, the rest is ignored", path, err, count)
+			break
+		}
+		b := make([]byte, length)
+		if _, err = io.ReadFull(r, b); err != nil {
+			break
+		}
+		parts := bytes.SplitN(b, []byte{' '}, 4)
+		if len(parts) < 4 {
+			continue
+		}
+		key := string(bytes.Join(parts[:3], []byte{' '}))
+		g, ok := index[key]
+		if !ok {
+			g = &group{precision: string(parts[2])}
+			g.db, _ = url.QueryUnescape(string(parts[0]))
+			g.rp, _ = url.QueryUnescape(string(parts[1]))
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.buf.Write(parts[3])
+		g.buf.WriteByte('\n')
+		count++
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF && err != ErrWALCorrupt {
+		return
+	}
+	for _, g := range groups {
+		if err = fn(g.db, g.rp, g.precision, g.buf.Bytes()); err != nil {
+			return
+		}
+	}
+	if count > 0 {
+		log.Printf("replay wal: %s, %d points", path, count)
+	}
+	return nil
+}
+
+// Close closes the current segment, and removes it if all its points have been flushed
+func (wal *WAL) Close() {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	wal.current.file.Sync()
+	wal.current.file.Close()
+	if wal.current.pending == 0 {
+		os.Remove(wal.path(wal.current.id))
+	}
+}
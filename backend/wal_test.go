@@ -0,0 +1,71 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := NewWAL("influxdb", dir, 1024)
+	if err != nil {
+		t.Fatalf("new wal error: %s", err)
+	}
+	seg, _ := wal.Append(&LinePoint{Db: "db1", Rp: "", Precision: "s", Line: []byte("cpu value=1 1596819659")})
+	wal.Append(&LinePoint{Db: "db1", Rp: "", Precision: "s", Line: []byte("cpu value=2 1596819660")})
+	wal.Done(seg, 2)
+	if fi, err := os.Stat(wal.path(seg.id)); err != nil || fi.Size() != 0 {
+		t.Errorf("expect the segment truncated, got %v %v", fi, err)
+	}
+
+	defer func(size int64) { WALSegmentSize = size }(WALSegmentSize)
+	WALSegmentSize = 64
+	seg, _ = wal.Append(&LinePoint{Db: "db 1", Rp: "rp", Precision: "ns", Line: []byte("mem value=1 1596819659000000000")})
+	wal.Append(&LinePoint{Db: "db 1", Rp: "rp", Precision: "ns", Line: []byte("mem value=2 1596819660000000000")})
+	wal.Append(&LinePoint{Db: "db2", Rp: "", Precision: "ms", Line: []byte("disk value=1 1596819659000")})
+	if wal.current == seg {
+		t.Fatal("expect the segment rotated")
+	}
+	// a corrupt record claiming 4 GiB is followed by a valid one
+	wal.current.file.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	wal.Append(&LinePoint{Db: "db2", Rp: "", Precision: "ms", Line: []byte("disk value=2 1596819660000")})
+	wal.Sync()
+	// the process is killed without any flush
+
+	wal, err = NewWAL("influxdb", dir, 1024)
+	if err != nil {
+		t.Fatalf("reopen wal error: %s", err)
+	}
+	got := make(map[string]string)
+	err = wal.Replay(func(db, rp, precision string, p []byte) error {
+		got[db+"/"+rp+"/"+precision] += string(p)
+		return nil
+	})
+	want := map[string]string{
+		"db 1/rp/ns": "mem value=1 1596819659000000000\nmem value=2 1596819660000000000\n",
+		"db2//ms":    "disk value=1 1596819659000\n",
+	}
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("got %v %v, want %v", got, err, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %q, want %q", k, got[k], v)
+		}
+	}
+	wal.Close()
+	if matches, _ := filepath.Glob(filepath.Join(dir, "influxdb.wal.*")); len(matches) != 0 {
+		t.Errorf("expect all segments removed, got %v", matches)
+	}
+}
@@ -3,11 +3,14 @@ module github.com/chengshiwen/influx-proxy
 go 1.16
 
 require (
+	github.com/golang/snappy v0.0.4
 	github.com/influxdata/influxdb1-client v0.0.0-20200827194710-b269163b24ab
 	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.13.6
 	github.com/mitchellh/gox v1.0.1 // indirect
 	github.com/panjf2000/ants/v2 v2.4.6
 	github.com/spf13/viper v1.9.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	stathat.com/c/consistent v1.0.0
 )
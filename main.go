@@ -5,12 +5,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
@@ -59,23 +62,134 @@ func main() {
 		return
 	}
 
+	ip := backend.NewProxy(cfg)
+	var services []interface{ Close() }
+	if cfg.OpenTSDB.Enabled {
+		ts := service.NewOpenTSDBService(cfg.OpenTSDB, ip)
+		err = ts.Open()
+		if err != nil {
+			log.Fatalf("opentsdb service start error: %s", err)
+			return
+		}
+		services = append(services, ts)
+	}
+	for _, gcfg := range cfg.Graphite {
+		if !gcfg.Enabled {
+			continue
+		}
+		gs, err := service.NewGraphiteService(gcfg, ip)
+		if err == nil {
+			err = gs.Open()
+		}
+		if err != nil {
+			log.Fatalf("graphite service start error: %s", err)
+			return
+		}
+		services = append(services, gs)
+	}
+	for _, ccfg := range cfg.Collectd {
+		if !ccfg.Enabled {
+			continue
+		}
+		cs, err := service.NewCollectdService(ccfg, ip)
+		if err == nil {
+			err = cs.Open()
+		}
+		if err != nil {
+			log.Fatalf("collectd service start error: %s", err)
+			return
+		}
+		services = append(services, cs)
+	}
+	for _, scfg := range cfg.Statsd {
+		if !scfg.Enabled {
+			continue
+		}
+		ss := service.NewStatsdService(scfg, ip)
+		err = ss.Open()
+		if err != nil {
+			log.Fatalf("statsd service start error: %s", err)
+			return
+		}
+		services = append(services, ss)
+	}
+	for _, ll := range ip.LineListeners {
+		ls := service.NewLineService(ll, ip)
+		err = ls.Open()
+		if err != nil {
+			log.Fatalf("line protocol service start error: %s", err)
+			return
+		}
+		services = append(services, ls)
+	}
+
 	mux := http.NewServeMux()
-	service.NewHttpService(cfg).Register(mux)
+	service.NewHttpService(cfg, ip).Register(mux)
 
 	server := &http.Server{
 		Addr:        cfg.ListenAddr,
 		Handler:     mux,
 		IdleTimeout: time.Duration(cfg.IdleTimeout) * time.Second,
 	}
-	if cfg.HTTPSEnabled {
-		log.Printf("https service start, listen on %s", server.Addr)
-		err = server.ListenAndServeTLS(cfg.HTTPSCert, cfg.HTTPSKey)
-	} else {
-		log.Printf("http service start, listen on %s", server.Addr)
-		err = server.ListenAndServe()
-	}
-	if err != nil {
+	errc := make(chan error, 1)
+	go func() {
+		if cfg.HTTPSEnabled {
+			log.Printf("https service start, listen on %s", server.Addr)
+			errc <- server.ListenAndServeTLS(cfg.HTTPSCert, cfg.HTTPSKey)
+		} else {
+			log.Printf("http service start, listen on %s", server.Addr)
+			errc <- server.ListenAndServe()
+		}
+	}()
+
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	go func() {
+		for range hupc {
+			log.Print("receive signal hangup, reloading config")
+			if _, err := ip.Reload(false); err != nil {
+				log.Printf("reload error: %s", err)
+			}
+		}
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	code := 0
+	select {
+	case sig := <-sigc:
+		log.Printf("receive signal %s, shutting down", sig)
+	case err = <-errc:
 		log.Print(err)
-		return
+		code = 1
+	}
+	signal.Stop(sigc)
+	// the shutdown timeout may have been reloaded
+	if !shutdown(server, services, ip, time.Duration(ip.Config().ShutdownTimeout)*time.Second) {
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// shutdown stops accepting the writes, and drains the buffers of all backends within the timeout
+func shutdown(server *http.Server, services []interface{ Close() }, ip *backend.Proxy, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	drained := true
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("http service shutdown error: %s", err)
+		drained = false
+	}
+	// the services are closed before the backends, since statsd flushes the remaining metrics on close
+	for _, s := range services {
+		s.Close()
+	}
+	if err := ip.Close(ctx); err != nil {
+		log.Printf("backends drain error: %s", err)
+		return false
+	}
+	if drained {
+		log.Print("shutdown completed")
 	}
+	return drained
 }
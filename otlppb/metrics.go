@@ -0,0 +1,681 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package otlppb
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var ErrInvalidProto = errors.New("invalid protobuf message")
+
+// AnyValue is the value of an attribute, the bytes value is not supported
+type AnyValue struct {
+	StringValue *string       `json:"stringValue,omitempty"`
+	BoolValue   *bool         `json:"boolValue,omitempty"`
+	IntValue    *int64        `json:"intValue,omitempty"`
+	DoubleValue *float64      `json:"doubleValue,omitempty"`
+	ArrayValue  *ArrayValue   `json:"arrayValue,omitempty"`
+	KvlistValue *KeyValueList `json:"kvlistValue,omitempty"`
+}
+
+type ArrayValue struct {
+	Values []AnyValue `json:"values"`
+}
+
+type KeyValueList struct {
+	Values []KeyValue `json:"values"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type InstrumentationScope struct {
+	Name       string     `json:"name"`
+	Version    string     `json:"version"`
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type NumberDataPoint struct {
+	Attributes        []KeyValue `json:"attributes"`
+	StartTimeUnixNano uint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      uint64     `json:"timeUnixNano"`
+	AsDouble          *float64   `json:"asDouble,omitempty"`
+	AsInt             *int64     `json:"asInt,omitempty"`
+}
+
+type HistogramDataPoint struct {
+	Attributes        []KeyValue `json:"attributes"`
+	StartTimeUnixNano uint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      uint64     `json:"timeUnixNano"`
+	Count             uint64     `json:"count"`
+	Sum               *float64   `json:"sum,omitempty"`
+	BucketCounts      []uint64   `json:"bucketCounts"`
+	ExplicitBounds    []float64  `json:"explicitBounds"`
+	Min               *float64   `json:"min,omitempty"`
+	Max               *float64   `json:"max,omitempty"`
+}
+
+type ValueAtQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type SummaryDataPoint struct {
+	Attributes        []KeyValue        `json:"attributes"`
+	StartTimeUnixNano uint64            `json:"startTimeUnixNano"`
+	TimeUnixNano      uint64            `json:"timeUnixNano"`
+	Count             uint64            `json:"count"`
+	Sum               float64           `json:"sum"`
+	QuantileValues    []ValueAtQuantile `json:"quantileValues"`
+}
+
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+type Sum struct {
+	DataPoints  []NumberDataPoint `json:"dataPoints"`
+	IsMonotonic bool              `json:"isMonotonic"`
+}
+
+type Histogram struct {
+	DataPoints []HistogramDataPoint `json:"dataPoints"`
+}
+
+type Summary struct {
+	DataPoints []SummaryDataPoint `json:"dataPoints"`
+}
+
+// Metric has one of the data, the exponential histogram is not supported
+type Metric struct {
+	Name      string     `json:"name"`
+	Unit      string     `json:"unit"`
+	Gauge     *Gauge     `json:"gauge,omitempty"`
+	Sum       *Sum       `json:"sum,omitempty"`
+	Histogram *Histogram `json:"histogram,omitempty"`
+	Summary   *Summary   `json:"summary,omitempty"`
+}
+
+type ScopeMetrics struct {
+	Scope   InstrumentationScope `json:"scope"`
+	Metrics []Metric             `json:"metrics"`
+}
+
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+}
+
+type ExportMetricsServiceRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+type ExportMetricsPartialSuccess struct {
+	RejectedDataPoints int64  `json:"rejectedDataPoints,string,omitempty"`
+	ErrorMessage       string `json:"errorMessage,omitempty"`
+}
+
+type ExportMetricsServiceResponse struct {
+	PartialSuccess *ExportMetricsPartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+// String returns the string of the value, the array and kvlist values are in json
+func (v *AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(*v.IntValue, 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+	case v.ArrayValue != nil:
+		arr := make([]string, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			arr[i] = v.ArrayValue.Values[i].String()
+		}
+		b, _ := json.Marshal(arr)
+		return string(b)
+	case v.KvlistValue != nil:
+		kv := make(map[string]string, len(v.KvlistValue.Values))
+		for i := range v.KvlistValue.Values {
+			kv[v.KvlistValue.Values[i].Key] = v.KvlistValue.Values[i].Value.String()
+		}
+		b, _ := json.Marshal(kv)
+		return string(b)
+	}
+	return ""
+}
+
+// UnmarshalJSON accepts the 64-bit integers in strings as the json encoding of protobuf, or in numbers
+func (v *AnyValue) UnmarshalJSON(b []byte) error {
+	type alias AnyValue
+	aux := struct {
+		*alias
+		IntValue *json.Number `json:"intValue,omitempty"`
+	}{alias: (*alias)(v)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if aux.IntValue != nil {
+		i, err := aux.IntValue.Int64()
+		if err != nil {
+			return err
+		}
+		v.IntValue = &i
+	}
+	return nil
+}
+
+func (p *NumberDataPoint) UnmarshalJSON(b []byte) error {
+	type alias NumberDataPoint
+	aux := struct {
+		*alias
+		StartTimeUnixNano json.Number  `json:"startTimeUnixNano"`
+		TimeUnixNano      json.Number  `json:"timeUnixNano"`
+		AsInt             *json.Number `json:"asInt,omitempty"`
+	}{alias: (*alias)(p)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	var err error
+	if p.StartTimeUnixNano, err = parseUint64(aux.StartTimeUnixNano); err != nil {
+		return err
+	}
+	if p.TimeUnixNano, err = parseUint64(aux.TimeUnixNano); err != nil {
+		return err
+	}
+	if aux.AsInt != nil {
+		i, err := aux.AsInt.Int64()
+		if err != nil {
+			return err
+		}
+		p.AsInt = &i
+	}
+	return nil
+}
+
+func (p *HistogramDataPoint) UnmarshalJSON(b []byte) error {
+	type alias HistogramDataPoint
+	aux := struct {
+		*alias
+		StartTimeUnixNano json.Number   `json:"startTimeUnixNano"`
+		TimeUnixNano      json.Number   `json:"timeUnixNano"`
+		Count             json.Number   `json:"count"`
+		BucketCounts      []json.Number `json:"bucketCounts"`
+	}{alias: (*alias)(p)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	var err error
+	if p.StartTimeUnixNano, err = parseUint64(aux.StartTimeUnixNano); err != nil {
+		return err
+	}
+	if p.TimeUnixNano, err = parseUint64(aux.TimeUnixNano); err != nil {
+		return err
+	}
+	if p.Count, err = parseUint64(aux.Count); err != nil {
+		return err
+	}
+	p.BucketCounts = make([]uint64, len(aux.BucketCounts))
+	for i, n := range aux.BucketCounts {
+		if p.BucketCounts[i], err = parseUint64(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *SummaryDataPoint) UnmarshalJSON(b []byte) error {
+	type alias SummaryDataPoint
+	aux := struct {
+		*alias
+		StartTimeUnixNano json.Number `json:"startTimeUnixNano"`
+		TimeUnixNano      json.Number `json:"timeUnixNano"`
+		Count             json.Number `json:"count"`
+	}{alias: (*alias)(p)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	var err error
+	if p.StartTimeUnixNano, err = parseUint64(aux.StartTimeUnixNano); err != nil {
+		return err
+	}
+	if p.TimeUnixNano, err = parseUint64(aux.TimeUnixNano); err != nil {
+		return err
+	}
+	p.Count, err = parseUint64(aux.Count)
+	return err
+}
+
+func parseUint64(n json.Number) (uint64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(n), 10, 64)
+}
+
+// fieldFunc handles a field of a message, and returns the bytes consumed or a negative number on error
+type fieldFunc func(num protowire.Number, typ protowire.Type, b []byte) int
+
+func unmarshal(b []byte, fn fieldFunc) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ErrInvalidProto
+		}
+		b = b[n:]
+		m := fn(num, typ, b)
+		if m == 0 {
+			m = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if m < 0 {
+			return ErrInvalidProto
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+// consumeMessage consumes a length-delimited field and unmarshals it with fn
+func consumeMessage(typ protowire.Type, b []byte, fn func([]byte) error) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 || fn(v) != nil {
+		return -1
+	}
+	return n
+}
+
+func consumeString(typ protowire.Type, b []byte, s *string) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*s = string(v)
+	}
+	return n
+}
+
+func consumeVarint(typ protowire.Type, b []byte, i *uint64) int {
+	if typ != protowire.VarintType {
+		return -1
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n >= 0 {
+		*i = v
+	}
+	return n
+}
+
+func consumeFixed64(typ protowire.Type, b []byte, i *uint64) int {
+	if typ != protowire.Fixed64Type {
+		return -1
+	}
+	v, n := protowire.ConsumeFixed64(b)
+	if n >= 0 {
+		*i = v
+	}
+	return n
+}
+
+func consumeDouble(typ protowire.Type, b []byte, f **float64) int {
+	var v uint64
+	n := consumeFixed64(typ, b, &v)
+	if n >= 0 {
+		d := math.Float64frombits(v)
+		*f = &d
+	}
+	return n
+}
+
+// consumeRepeatedFixed64 consumes a packed or unpacked element of the repeated fixed64 or double field
+func consumeRepeatedFixed64(typ protowire.Type, b []byte, fn func(uint64)) int {
+	if typ == protowire.Fixed64Type {
+		v, n := protowire.ConsumeFixed64(b)
+		if n >= 0 {
+			fn(v)
+		}
+		return n
+	}
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 || len(v)%8 != 0 {
+		return -1
+	}
+	for len(v) > 0 {
+		x, _ := protowire.ConsumeFixed64(v)
+		fn(x)
+		v = v[8:]
+	}
+	return n
+}
+
+func consumeAttribute(typ protowire.Type, b []byte, attrs *[]KeyValue) int {
+	return consumeMessage(typ, b, func(v []byte) error {
+		*attrs = append(*attrs, KeyValue{})
+		return (*attrs)[len(*attrs)-1].Unmarshal(v)
+	})
+}
+
+func (v *AnyValue) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			var s string
+			n := consumeString(typ, b, &s)
+			v.StringValue = &s
+			return n
+		case 2:
+			var i uint64
+			n := consumeVarint(typ, b, &i)
+			t := i != 0
+			v.BoolValue = &t
+			return n
+		case 3:
+			var i uint64
+			n := consumeVarint(typ, b, &i)
+			t := int64(i)
+			v.IntValue = &t
+			return n
+		case 4:
+			return consumeDouble(typ, b, &v.DoubleValue)
+		case 5:
+			v.ArrayValue = &ArrayValue{}
+			return consumeMessage(typ, b, func(m []byte) error {
+				return unmarshal(m, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num != 1 {
+						return 0
+					}
+					return consumeMessage(typ, b, func(e []byte) error {
+						v.ArrayValue.Values = append(v.ArrayValue.Values, AnyValue{})
+						return v.ArrayValue.Values[len(v.ArrayValue.Values)-1].Unmarshal(e)
+					})
+				})
+			})
+		case 6:
+			v.KvlistValue = &KeyValueList{}
+			return consumeMessage(typ, b, func(m []byte) error {
+				return unmarshal(m, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num == 1 {
+						return consumeAttribute(typ, b, &v.KvlistValue.Values)
+					}
+					return 0
+				})
+			})
+		}
+		return 0
+	})
+}
+
+func (kv *KeyValue) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &kv.Key)
+		case 2:
+			return consumeMessage(typ, b, kv.Value.Unmarshal)
+		}
+		return 0
+	})
+}
+
+func (r *Resource) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeAttribute(typ, b, &r.Attributes)
+		}
+		return 0
+	})
+}
+
+func (s *InstrumentationScope) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &s.Name)
+		case 2:
+			return consumeString(typ, b, &s.Version)
+		case 3:
+			return consumeAttribute(typ, b, &s.Attributes)
+		}
+		return 0
+	})
+}
+
+func (p *NumberDataPoint) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 7:
+			return consumeAttribute(typ, b, &p.Attributes)
+		case 2:
+			return consumeFixed64(typ, b, &p.StartTimeUnixNano)
+		case 3:
+			return consumeFixed64(typ, b, &p.TimeUnixNano)
+		case 4:
+			return consumeDouble(typ, b, &p.AsDouble)
+		case 6:
+			var v uint64
+			n := consumeFixed64(typ, b, &v)
+			i := int64(v)
+			p.AsInt = &i
+			return n
+		}
+		return 0
+	})
+}
+
+func (p *HistogramDataPoint) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 9:
+			return consumeAttribute(typ, b, &p.Attributes)
+		case 2:
+			return consumeFixed64(typ, b, &p.StartTimeUnixNano)
+		case 3:
+			return consumeFixed64(typ, b, &p.TimeUnixNano)
+		case 4:
+			return consumeFixed64(typ, b, &p.Count)
+		case 5:
+			return consumeDouble(typ, b, &p.Sum)
+		case 6:
+			return consumeRepeatedFixed64(typ, b, func(v uint64) { p.BucketCounts = append(p.BucketCounts, v) })
+		case 7:
+			return consumeRepeatedFixed64(typ, b, func(v uint64) { p.ExplicitBounds = append(p.ExplicitBounds, math.Float64frombits(v)) })
+		case 11:
+			return consumeDouble(typ, b, &p.Min)
+		case 12:
+			return consumeDouble(typ, b, &p.Max)
+		}
+		return 0
+	})
+}
+
+func (q *ValueAtQuantile) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		var v uint64
+		var n int
+		switch num {
+		case 1:
+			n = consumeFixed64(typ, b, &v)
+			q.Quantile = math.Float64frombits(v)
+		case 2:
+			n = consumeFixed64(typ, b, &v)
+			q.Value = math.Float64frombits(v)
+		}
+		return n
+	})
+}
+
+func (p *SummaryDataPoint) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 7:
+			return consumeAttribute(typ, b, &p.Attributes)
+		case 2:
+			return consumeFixed64(typ, b, &p.StartTimeUnixNano)
+		case 3:
+			return consumeFixed64(typ, b, &p.TimeUnixNano)
+		case 4:
+			return consumeFixed64(typ, b, &p.Count)
+		case 5:
+			var v uint64
+			n := consumeFixed64(typ, b, &v)
+			p.Sum = math.Float64frombits(v)
+			return n
+		case 6:
+			return consumeMessage(typ, b, func(v []byte) error {
+				p.QuantileValues = append(p.QuantileValues, ValueAtQuantile{})
+				return p.QuantileValues[len(p.QuantileValues)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (m *Metric) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Name)
+		case 3:
+			return consumeString(typ, b, &m.Unit)
+		case 5:
+			m.Gauge = &Gauge{}
+			return consumeMessage(typ, b, func(v []byte) error {
+				return unmarshal(v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num == 1 {
+						return consumeNumberDataPoint(typ, b, &m.Gauge.DataPoints)
+					}
+					return 0
+				})
+			})
+		case 7:
+			m.Sum = &Sum{}
+			return consumeMessage(typ, b, func(v []byte) error {
+				return unmarshal(v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					switch num {
+					case 1:
+						return consumeNumberDataPoint(typ, b, &m.Sum.DataPoints)
+					case 3:
+						var i uint64
+						n := consumeVarint(typ, b, &i)
+						m.Sum.IsMonotonic = i != 0
+						return n
+					}
+					return 0
+				})
+			})
+		case 9:
+			m.Histogram = &Histogram{}
+			return consumeMessage(typ, b, func(v []byte) error {
+				return unmarshal(v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num != 1 {
+						return 0
+					}
+					return consumeMessage(typ, b, func(v []byte) error {
+						m.Histogram.DataPoints = append(m.Histogram.DataPoints, HistogramDataPoint{})
+						return m.Histogram.DataPoints[len(m.Histogram.DataPoints)-1].Unmarshal(v)
+					})
+				})
+			})
+		case 11:
+			m.Summary = &Summary{}
+			return consumeMessage(typ, b, func(v []byte) error {
+				return unmarshal(v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num != 1 {
+						return 0
+					}
+					return consumeMessage(typ, b, func(v []byte) error {
+						m.Summary.DataPoints = append(m.Summary.DataPoints, SummaryDataPoint{})
+						return m.Summary.DataPoints[len(m.Summary.DataPoints)-1].Unmarshal(v)
+					})
+				})
+			})
+		}
+		return 0
+	})
+}
+
+func consumeNumberDataPoint(typ protowire.Type, b []byte, points *[]NumberDataPoint) int {
+	return consumeMessage(typ, b, func(v []byte) error {
+		*points = append(*points, NumberDataPoint{})
+		return (*points)[len(*points)-1].Unmarshal(v)
+	})
+}
+
+func (sm *ScopeMetrics) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeMessage(typ, b, sm.Scope.Unmarshal)
+		case 2:
+			return consumeMessage(typ, b, func(v []byte) error {
+				sm.Metrics = append(sm.Metrics, Metric{})
+				return sm.Metrics[len(sm.Metrics)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (rm *ResourceMetrics) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeMessage(typ, b, rm.Resource.Unmarshal)
+		case 2, 1000:
+			// 1000 is the deprecated instrumentation_library_metrics, which has the same layout
+			return consumeMessage(typ, b, func(v []byte) error {
+				rm.ScopeMetrics = append(rm.ScopeMetrics, ScopeMetrics{})
+				return rm.ScopeMetrics[len(rm.ScopeMetrics)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (req *ExportMetricsServiceRequest) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeMessage(typ, b, func(v []byte) error {
+				req.ResourceMetrics = append(req.ResourceMetrics, ResourceMetrics{})
+				return req.ResourceMetrics[len(req.ResourceMetrics)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (resp *ExportMetricsServiceResponse) Marshal(b []byte) []byte {
+	if resp.PartialSuccess == nil {
+		return b
+	}
+	ps := resp.PartialSuccess
+	var m []byte
+	m = protowire.AppendTag(m, 1, protowire.VarintType)
+	m = protowire.AppendVarint(m, uint64(ps.RejectedDataPoints))
+	m = protowire.AppendTag(m, 2, protowire.BytesType)
+	m = protowire.AppendString(m, ps.ErrorMessage)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
@@ -0,0 +1,331 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package prompb
+
+import (
+	"errors"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var ErrInvalidProto = errors.New("invalid protobuf message")
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// fieldFunc handles a field of a message, and returns the bytes consumed or a negative number on error
+type fieldFunc func(num protowire.Number, typ protowire.Type, b []byte) int
+
+func unmarshal(b []byte, fn fieldFunc) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ErrInvalidProto
+		}
+		b = b[n:]
+		m := fn(num, typ, b)
+		if m == 0 {
+			m = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if m < 0 {
+			return ErrInvalidProto
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+// consumeMessage consumes a length-delimited field and unmarshals it with fn
+func consumeMessage(typ protowire.Type, b []byte, fn func([]byte) error) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 || fn(v) != nil {
+		return -1
+	}
+	return n
+}
+
+func consumeString(typ protowire.Type, b []byte, s *string) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*s = string(v)
+	}
+	return n
+}
+
+func consumeInt64(typ protowire.Type, b []byte, i *int64) int {
+	if typ != protowire.VarintType {
+		return -1
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n >= 0 {
+		*i = int64(v)
+	}
+	return n
+}
+
+func (l *Label) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &l.Name)
+		case 2:
+			return consumeString(typ, b, &l.Value)
+		}
+		return 0
+	})
+}
+
+func (l *Label) Marshal(b []byte) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, l.Name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendString(b, l.Value)
+}
+
+func (s *Sample) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			if typ != protowire.Fixed64Type {
+				return -1
+			}
+			v, n := protowire.ConsumeFixed64(b)
+			if n >= 0 {
+				s.Value = math.Float64frombits(v)
+			}
+			return n
+		case 2:
+			return consumeInt64(typ, b, &s.Timestamp)
+		}
+		return 0
+	})
+}
+
+func (s *Sample) Marshal(b []byte) []byte {
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(s.Value))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(s.Timestamp))
+}
+
+func (ts *TimeSeries) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeMessage(typ, b, func(v []byte) error {
+				ts.Labels = append(ts.Labels, Label{})
+				return ts.Labels[len(ts.Labels)-1].Unmarshal(v)
+			})
+		case 2:
+			return consumeMessage(typ, b, func(v []byte) error {
+				ts.Samples = append(ts.Samples, Sample{})
+				return ts.Samples[len(ts.Samples)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (ts *TimeSeries) Marshal(b []byte) []byte {
+	for i := range ts.Labels {
+		b = appendMessage(b, 1, ts.Labels[i].Marshal)
+	}
+	for i := range ts.Samples {
+		b = appendMessage(b, 2, ts.Samples[i].Marshal)
+	}
+	return b
+}
+
+func (wr *WriteRequest) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeMessage(typ, b, func(v []byte) error {
+				wr.Timeseries = append(wr.Timeseries, TimeSeries{})
+				return wr.Timeseries[len(wr.Timeseries)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (wr *WriteRequest) Marshal(b []byte) []byte {
+	for i := range wr.Timeseries {
+		b = appendMessage(b, 1, wr.Timeseries[i].Marshal)
+	}
+	return b
+}
+
+// appendMessage appends an embedded message field
+func appendMessage(b []byte, num protowire.Number, marshal func([]byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, marshal(nil))
+}
+
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+type ReadRequest struct {
+	Queries []Query
+}
+
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+func (lm *LabelMatcher) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			var t int64
+			n := consumeInt64(typ, b, &t)
+			lm.Type = MatchType(t)
+			return n
+		case 2:
+			return consumeString(typ, b, &lm.Name)
+		case 3:
+			return consumeString(typ, b, &lm.Value)
+		}
+		return 0
+	})
+}
+
+func (lm *LabelMatcher) Marshal(b []byte) []byte {
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(lm.Type))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, lm.Name)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendString(b, lm.Value)
+}
+
+func (q *Query) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeInt64(typ, b, &q.StartTimestampMs)
+		case 2:
+			return consumeInt64(typ, b, &q.EndTimestampMs)
+		case 3:
+			return consumeMessage(typ, b, func(v []byte) error {
+				q.Matchers = append(q.Matchers, LabelMatcher{})
+				return q.Matchers[len(q.Matchers)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (q *Query) Marshal(b []byte) []byte {
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(q.StartTimestampMs))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(q.EndTimestampMs))
+	for i := range q.Matchers {
+		b = appendMessage(b, 3, q.Matchers[i].Marshal)
+	}
+	return b
+}
+
+func (rr *ReadRequest) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeMessage(typ, b, func(v []byte) error {
+				rr.Queries = append(rr.Queries, Query{})
+				return rr.Queries[len(rr.Queries)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (rr *ReadRequest) Marshal(b []byte) []byte {
+	for i := range rr.Queries {
+		b = appendMessage(b, 1, rr.Queries[i].Marshal)
+	}
+	return b
+}
+
+func (qr *QueryResult) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeMessage(typ, b, func(v []byte) error {
+				qr.Timeseries = append(qr.Timeseries, TimeSeries{})
+				return qr.Timeseries[len(qr.Timeseries)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (qr *QueryResult) Marshal(b []byte) []byte {
+	for i := range qr.Timeseries {
+		b = appendMessage(b, 1, qr.Timeseries[i].Marshal)
+	}
+	return b
+}
+
+func (rr *ReadResponse) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeMessage(typ, b, func(v []byte) error {
+				rr.Results = append(rr.Results, QueryResult{})
+				return rr.Results[len(rr.Results)-1].Unmarshal(v)
+			})
+		}
+		return 0
+	})
+}
+
+func (rr *ReadResponse) Marshal(b []byte) []byte {
+	for i := range rr.Results {
+		b = appendMessage(b, 1, rr.Results[i].Marshal)
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"log"
+	"net"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// CollectdService accepts the packets of the collectd binary protocol on udp
+type CollectdService struct {
+	ip         *backend.Proxy
+	parser     *backend.CollectdParser
+	bindAddr   string
+	db         string
+	rp         string
+	readBuffer int
+	us         *udpServer
+}
+
+func NewCollectdService(cfg *backend.CollectdConfig, ip *backend.Proxy) (*CollectdService, error) {
+	types, err := backend.LoadCollectdTypes(cfg.TypesDB)
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]string
+	if cfg.AuthFile != "" {
+		if users, err = backend.LoadCollectdAuthFile(cfg.AuthFile); err != nil {
+			return nil, err
+		}
+	}
+	parser, err := backend.NewCollectdParser(types, users, cfg.SecurityLevel)
+	if err != nil {
+		return nil, err
+	}
+	return &CollectdService{
+		ip:         ip,
+		parser:     parser,
+		bindAddr:   cfg.BindAddr,
+		db:         cfg.Database,
+		rp:         cfg.RetentionPolicy,
+		readBuffer: cfg.ReadBuffer,
+	}, nil
+}
+
+func (s *CollectdService) Open() (err error) {
+	s.us, err = listenUDP("collectd", s.bindAddr, s.readBuffer, s.handlePacket)
+	return
+}
+
+func (s *CollectdService) Close() {
+	if s.us != nil {
+		s.us.Close()
+	}
+}
+
+func (s *CollectdService) handlePacket(buf []byte, addr net.Addr) {
+	lines, err := s.parser.Parse(buf)
+	if err != nil {
+		log.Printf("collectd parse error: %s, client: %s", err, addr)
+	}
+	for _, line := range lines {
+		if err = s.ip.WriteRow(line, s.db, s.rp, "ns"); err != nil {
+			log.Printf("collectd write error: %s, line: %s, client: %s", err, line, addr)
+		}
+	}
+	s.ip.SyncWAL()
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"log"
+	"net"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// GraphiteService accepts the graphite plaintext lines on tcp or udp
+type GraphiteService struct {
+	ip         *backend.Proxy
+	parser     *backend.GraphiteParser
+	bindAddr   string
+	protocol   string
+	db         string
+	rp         string
+	readBuffer int
+	ts         *tcpServer
+	us         *udpServer
+}
+
+func NewGraphiteService(cfg *backend.GraphiteConfig, ip *backend.Proxy) (*GraphiteService, error) {
+	parser, err := backend.NewGraphiteParser(cfg.Separator, cfg.Templates, cfg.Tags)
+	if err != nil {
+		return nil, err
+	}
+	return &GraphiteService{
+		ip:         ip,
+		parser:     parser,
+		bindAddr:   cfg.BindAddr,
+		protocol:   cfg.Protocol,
+		db:         cfg.Database,
+		rp:         cfg.RetentionPolicy,
+		readBuffer: cfg.UDPReadBuffer,
+	}, nil
+}
+
+func (s *GraphiteService) Open() (err error) {
+	if s.protocol == "udp" {
+		s.us, err = listenUDP("graphite", s.bindAddr, s.readBuffer, s.handlePacket)
+		return
+	}
+	s.ts, err = listenTCP("graphite", s.bindAddr, s.handleConn)
+	return
+}
+
+func (s *GraphiteService) Close() {
+	if s.ts != nil {
+		s.ts.Close()
+	}
+	if s.us != nil {
+		s.us.Close()
+	}
+}
+
+func (s *GraphiteService) handleConn(conn net.Conn) {
+	defer conn.Close()
+	readLines("graphite", conn, conn, s.ip.Config().MaxLineSize, func(line string) {
+		s.handleLine(line, conn.RemoteAddr())
+	}, s.ip.SyncWAL)
+}
+
+func (s *GraphiteService) handlePacket(buf []byte, addr net.Addr) {
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			s.handleLine(string(line), addr)
+		}
+	}
+	s.ip.SyncWAL()
+}
+
+func (s *GraphiteService) handleLine(line string, addr net.Addr) {
+	point, err := s.parser.Parse(line)
+	if err == backend.ErrGraphiteInvalidValue {
+		return
+	}
+	if err == nil {
+		err = s.ip.WriteRow(point, s.db, s.rp, "ns")
+	}
+	if err != nil {
+		log.Printf("graphite error: %s, line: %s, client: %s", err, line, addr)
+	}
+}
@@ -5,10 +5,12 @@
 package service
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -28,28 +30,20 @@ var (
 	ErrInvalidBatch   = errors.New("invalid batch, require positive integer")
 	ErrInvalidLimit   = errors.New("invalid limit, require positive integer")
 	ErrInvalidHaAddrs = errors.New("invalid ha_addrs, require at least two addresses as <host:port>, comma-separated")
+	ErrBodyTooLarge   = errors.New("request body too large")
 )
 
+// HttpService serves the http api, and reads the auth, tracing and limits from the config in effect of the proxy,
+// so that they are applied by reload
 type HttpService struct { // nolint:golint
-	ip           *backend.Proxy
-	tx           *transfer.Transfer
-	Username     string
-	Password     string
-	AuthEncrypt  bool
-	WriteTracing bool
-	QueryTracing bool
+	ip *backend.Proxy
+	tx *transfer.Transfer
 }
 
-func NewHttpService(cfg *backend.ProxyConfig) (hs *HttpService) { // nolint:golint
-	ip := backend.NewProxy(cfg)
+func NewHttpService(cfg *backend.ProxyConfig, ip *backend.Proxy) (hs *HttpService) { // nolint:golint
 	hs = &HttpService{
-		ip:           ip,
-		tx:           transfer.NewTransfer(cfg, ip.Circles),
-		Username:     cfg.Username,
-		Password:     cfg.Password,
-		AuthEncrypt:  cfg.AuthEncrypt,
-		WriteTracing: cfg.WriteTracing,
-		QueryTracing: cfg.QueryTracing,
+		ip: ip,
+		tx: transfer.NewTransfer(cfg, ip.Circles),
 	}
 	return
 }
@@ -59,7 +53,13 @@ func (hs *HttpService) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/query", hs.HandlerQuery)
 	mux.HandleFunc("/write", hs.HandlerWrite)
 	mux.HandleFunc("/health", hs.HandlerHealth)
+	mux.HandleFunc("/stats", hs.HandlerStats)
 	mux.HandleFunc("/replica", hs.HandlerReplica)
+	mux.HandleFunc("/api/v1/prom/write", hs.HandlerPromWrite)
+	mux.HandleFunc("/api/v1/prom/read", hs.HandlerPromRead)
+	mux.HandleFunc("/api/v2/query", hs.HandlerV2Query)
+	mux.HandleFunc("/api/v2/write", hs.HandlerV2Write)
+	mux.HandleFunc("/v1/metrics", hs.HandlerOTLPMetrics)
 	mux.HandleFunc("/encrypt", hs.HandlerEncrypt)
 	mux.HandleFunc("/decrypt", hs.HandlerDencrypt)
 	mux.HandleFunc("/rebalance", hs.HandlerRebalance)
@@ -68,6 +68,7 @@ func (hs *HttpService) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/cleanup", hs.HandlerCleanup)
 	mux.HandleFunc("/transfer/state", hs.HandlerTransferState)
 	mux.HandleFunc("/transfer/stats", hs.HandlerTransferStats)
+	mux.HandleFunc("/reload", hs.HandlerReload)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 }
@@ -92,7 +93,7 @@ func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	hs.WriteBody(w, body)
-	if hs.QueryTracing {
+	if hs.ip.Config().QueryTracing {
 		log.Printf("query: %s %s %s, client: %s", req.Method, db, q, req.RemoteAddr)
 	}
 }
@@ -116,38 +117,74 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 	}
 
 	db := req.URL.Query().Get("db")
-	if db == "" {
-		hs.WriteError(w, req, 400, "database not found")
+	if !hs.checkDatabase(w, req, db) {
 		return
 	}
-	if len(hs.ip.DBSet) > 0 && !hs.ip.DBSet[db] {
-		hs.WriteError(w, req, 400, fmt.Sprintf("database forbidden: %s", db))
+	rp := req.URL.Query().Get("rp")
+	level, err := backend.ParseConsistencyLevel(req.URL.Query().Get("consistency"))
+	if err != nil {
+		hs.WriteError(w, req, 400, err.Error())
 		return
 	}
-	rp := req.URL.Query().Get("rp")
 
-	body := req.Body
-	if req.Header.Get("Content-Encoding") == "gzip" {
-		b, err := gzip.NewReader(body)
-		if err != nil {
-			hs.WriteError(w, req, 400, "unable to decode gzip body")
-			return
-		}
-		defer b.Close()
-		body = b
-	}
-	p, err := ioutil.ReadAll(body)
+	cfg := hs.ip.Config()
+	body, err := bodyReader(req, int64(cfg.MaxBodySize))
 	if err != nil {
 		hs.WriteError(w, req, 400, err.Error())
 		return
 	}
+	defer body.Close()
+	var r io.Reader = body
+	var trace bytes.Buffer
+	if cfg.WriteTracing {
+		r = io.TeeReader(body, &trace)
+	}
 
-	err = hs.ip.Write(p, db, rp, precision)
-	if err == nil {
-		hs.WriteHeader(w, 204)
+	var pts []*backend.JSONPoint
+	jsonBody := strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+	if jsonBody {
+		p, err := ioutil.ReadAll(r)
+		if err != nil {
+			hs.WriteError(w, req, bodyErrorStatus(err), err.Error())
+			return
+		}
+		if pts, err = backend.ParseJSONPoints(p); err != nil {
+			hs.WriteError(w, req, 400, "unable to parse json: "+err.Error())
+			return
+		}
+	}
+
+	var wt *backend.WriteTracker
+	if level != backend.ConsistencyNone {
+		wt = hs.ip.NewWriteTracker(level)
+	}
+	if jsonBody {
+		err = hs.ip.WriteJSON(pts, db, rp, precision, wt)
+	} else {
+		// the lines are written as they are read, and the reading error aborts the rest of the body
+		err = hs.ip.WriteReader(r, db, rp, precision, wt)
+		if _, ok := err.(*backend.PartialWriteError); !ok && err != nil && err != backend.ErrBackendOverloaded && !errors.Is(err, backend.ErrBufferFailed) {
+			log.Printf("write body error: %s, db: %s, rp: %s, precision: %s, client: %s", err, db, rp, precision, req.RemoteAddr)
+			hs.WriteError(w, req, bodyErrorStatus(err), err.Error())
+			return
+		}
 	}
-	if hs.WriteTracing {
-		log.Printf("write: %s %s %s %s, client: %s", db, rp, precision, p, req.RemoteAddr)
+	if wt != nil {
+		if werr := wt.Wait(req.Context()); werr != nil {
+			if err == nil {
+				err = werr
+			} else if err != backend.ErrBackendOverloaded {
+				// both the dropped lines and the unmet consistency are reported
+				err = fmt.Errorf("%s; %w", err, werr)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("write error: %s, db: %s, rp: %s, precision: %s, client: %s", err, db, rp, precision, req.RemoteAddr)
+	}
+	hs.WriteResult(w, req, err)
+	if cfg.WriteTracing {
+		log.Printf("write: %s %s %s %s, client: %s", db, rp, precision, trace.Bytes(), req.RemoteAddr)
 	}
 }
 
@@ -160,6 +197,14 @@ func (hs *HttpService) HandlerHealth(w http.ResponseWriter, req *http.Request) {
 	hs.Write(w, req, 200, hs.ip.GetHealth(stats))
 }
 
+func (hs *HttpService) HandlerStats(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+	hs.Write(w, req, 200, hs.ip.GetStats())
+}
+
 func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	if !hs.checkMethodAndAuth(w, req, "GET") {
@@ -169,6 +214,10 @@ func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request)
 	db := req.FormValue("db")
 	meas := req.FormValue("meas")
 	if db != "" && meas != "" {
+		if tags := hs.ip.ShardRules.Tags(db, meas); len(tags) > 0 {
+			hs.WriteError(w, req, 400, fmt.Sprintf("measurement %s is sharded by tags %v in all backends", meas, tags))
+			return
+		}
 		key := backend.GetKey(db, meas)
 		backends := hs.ip.GetBackends(key)
 		data := make([]map[string]interface{}, len(backends))
@@ -450,6 +499,33 @@ func (hs *HttpService) HandlerTransferStats(w http.ResponseWriter, req *http.Req
 	}
 }
 
+// HandlerReload re-reads the config file and applies the safe fields, the changes of circles are refused unless force=true
+func (hs *HttpService) HandlerReload(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	force := false
+	if req.FormValue("force") != "" {
+		var err error
+		if force, err = hs.formBool(req, "force"); err != nil {
+			hs.WriteError(w, req, 400, "invalid force")
+			return
+		}
+	}
+	if _, err := hs.ip.Reload(force); err != nil {
+		log.Printf("reload error: %s, client: %s", err, req.RemoteAddr)
+		if errors.Is(err, backend.ErrCirclesChanged) {
+			hs.WriteError(w, req, 409, err.Error())
+		} else {
+			hs.WriteError(w, req, 400, err.Error())
+		}
+		return
+	}
+	hs.WriteText(w, 200, "reloaded")
+}
+
 func (hs *HttpService) Write(w http.ResponseWriter, req *http.Request, status int, data interface{}) {
 	if status >= 400 {
 		hs.WriteError(w, req, status, data.(string))
@@ -470,6 +546,29 @@ func (hs *HttpService) WriteError(w http.ResponseWriter, req *http.Request, stat
 	w.Write(util.MarshalJSON(rsp, pretty))
 }
 
+// WriteResult responds to the write request according to the error
+func (hs *HttpService) WriteResult(w http.ResponseWriter, req *http.Request, err error) {
+	switch err.(type) {
+	case nil:
+		hs.WriteHeader(w, 204)
+	case *backend.PartialWriteError:
+		hs.WriteError(w, req, 400, err.Error())
+	default:
+		hs.WriteError(w, req, hs.writeErrorStatus(w, err), err.Error())
+	}
+}
+
+// writeErrorStatus returns the status of the write error other than partial write,
+// and sets Retry-After when the backends are overloaded
+func (hs *HttpService) writeErrorStatus(w http.ResponseWriter, err error) int {
+	if err == backend.ErrBackendOverloaded {
+		cfg := hs.ip.Config()
+		w.Header().Set("Retry-After", strconv.Itoa(cfg.RetryAfter))
+		return cfg.OverflowStatus
+	}
+	return 500
+}
+
 func (hs *HttpService) WriteBody(w http.ResponseWriter, body []byte) {
 	hs.WriteHeader(w, 200)
 	w.Write(body)
@@ -500,26 +599,106 @@ func (hs *HttpService) checkMethod(w http.ResponseWriter, req *http.Request, met
 }
 
 func (hs *HttpService) checkAuth(w http.ResponseWriter, req *http.Request) bool {
-	if hs.Username == "" && hs.Password == "" {
+	if checkRequestAuth(hs.ip.Config(), req) {
+		return true
+	}
+	hs.WriteError(w, req, 401, "authentication failed")
+	return false
+}
+
+// checkRequestAuth reports whether the request carries the auth of the config by the query or the basic auth
+func checkRequestAuth(cfg *backend.ProxyConfig, req *http.Request) bool {
+	if cfg.Username == "" && cfg.Password == "" {
 		return true
 	}
 	u, p := req.URL.Query().Get("u"), req.URL.Query().Get("p")
-	if hs.transAuth(u) == hs.Username && hs.transAuth(p) == hs.Password {
+	if matchAuth(cfg, u, p) {
 		return true
 	}
 	u, p, ok := req.BasicAuth()
-	if ok && hs.transAuth(u) == hs.Username && hs.transAuth(p) == hs.Password {
-		return true
+	return ok && matchAuth(cfg, u, p)
+}
+
+// limitReader fails with ErrBodyTooLarge once more than n bytes are read
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitReader) Read(p []byte) (n int, err error) {
+	if lr.n < 0 {
+		return 0, ErrBodyTooLarge
 	}
-	hs.WriteError(w, req, 401, "authentication failed")
-	return false
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err = lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		// the extra byte only tells that the body is too large
+		return n - 1, ErrBodyTooLarge
+	}
+	return
+}
+
+// limitBody limits the body by the max body size, 0 means unlimited
+func limitBody(body io.Reader, maxBodySize int64) io.Reader {
+	if maxBodySize > 0 {
+		return &limitReader{r: body, n: maxBodySize}
+	}
+	return body
+}
+
+// bodyReader returns the body decompressed by gzip if needed, and the max body size limits the decompressed body
+func bodyReader(req *http.Request, maxBodySize int64) (io.ReadCloser, error) {
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		b, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, errors.New("unable to decode gzip body")
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{limitBody(b, maxBodySize), b}, nil
+	}
+	return ioutil.NopCloser(limitBody(req.Body, maxBodySize)), nil
+}
+
+func readBody(req *http.Request, maxBodySize int64) ([]byte, error) {
+	body, err := bodyReader(req, maxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// bodyErrorStatus returns 413 when the body or a line is too large, otherwise 400
+func bodyErrorStatus(err error) int {
+	if err == ErrBodyTooLarge || err == backend.ErrLineTooLong {
+		return 413
+	}
+	return 400
+}
+
+func (hs *HttpService) checkDatabase(w http.ResponseWriter, req *http.Request, db string) bool {
+	if db == "" {
+		hs.WriteError(w, req, 400, "database not found")
+		return false
+	}
+	if !hs.ip.AllowDatabase(db) {
+		hs.WriteError(w, req, 400, fmt.Sprintf("database forbidden: %s", db))
+		return false
+	}
+	return true
 }
 
-func (hs *HttpService) transAuth(text string) string {
-	if hs.AuthEncrypt {
-		return util.AesEncrypt(text)
+// matchAuth reports whether the username and password match the auth of the config
+func matchAuth(cfg *backend.ProxyConfig, username, password string) bool {
+	if cfg.AuthEncrypt {
+		username, password = util.AesEncrypt(username), util.AesEncrypt(password)
 	}
-	return text
+	return username == cfg.Username && password == cfg.Password
 }
 
 func (hs *HttpService) formValues(req *http.Request, key string) []string {
@@ -0,0 +1,64 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"log"
+	"net"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// LineService accepts the line protocol on udp or tcp, each udp packet or tcp line is written like /write
+type LineService struct {
+	ip *backend.Proxy
+	ll *backend.LineListener
+	ts *tcpServer
+	us *udpServer
+}
+
+func NewLineService(ll *backend.LineListener, ip *backend.Proxy) *LineService {
+	return &LineService{ip: ip, ll: ll}
+}
+
+func (s *LineService) Open() (err error) {
+	if s.ll.Protocol == "udp" {
+		s.us, err = listenUDP("line protocol", s.ll.BindAddr, s.ll.ReadBuffer, s.handlePacket)
+		return
+	}
+	s.ts, err = listenTCP("line protocol", s.ll.BindAddr, s.handleConn)
+	return
+}
+
+func (s *LineService) Close() {
+	if s.ts != nil {
+		s.ts.Close()
+	}
+	if s.us != nil {
+		s.us.Close()
+	}
+}
+
+func (s *LineService) handleConn(conn net.Conn) {
+	defer conn.Close()
+	if tc, ok := conn.(*net.TCPConn); ok && s.ll.ReadBuffer > 0 {
+		tc.SetReadBuffer(s.ll.ReadBuffer)
+	}
+	readLines("line protocol", conn, conn, s.ip.Config().MaxLineSize, func(line string) {
+		s.write([]byte(line), conn.RemoteAddr())
+	}, s.ip.SyncWAL)
+}
+
+func (s *LineService) handlePacket(buf []byte, addr net.Addr) {
+	s.write(buf, addr)
+	s.ip.SyncWAL()
+}
+
+func (s *LineService) write(buf []byte, addr net.Addr) {
+	err := s.ip.WriteListener(s.ll, buf)
+	if err != nil {
+		log.Printf("line protocol %s error: %s, db: %s, client: %s", s.ll.Protocol, err, s.ll.Database, addr)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+const MaxUDPPayload = 64 * 1024
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// tcpServer accepts the connections and tracks them to close on shutdown
+type tcpServer struct {
+	name  string
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+	lock  sync.Mutex
+	wg    sync.WaitGroup
+}
+
+func listenTCP(name, addr string, handle func(net.Conn)) (ts *tcpServer, err error) {
+	ts = &tcpServer{name: name, conns: make(map[net.Conn]struct{})}
+	ts.ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ts.wg.Add(1)
+	go ts.serve(handle)
+	log.Printf("%s tcp service start, listen on %s", name, ts.ln.Addr())
+	return
+}
+
+func (ts *tcpServer) serve(handle func(net.Conn)) {
+	defer ts.wg.Done()
+	for {
+		conn, err := ts.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("%s accept error: %s", ts.name, err)
+			continue
+		}
+		ts.lock.Lock()
+		ts.conns[conn] = struct{}{}
+		ts.lock.Unlock()
+		ts.wg.Add(1)
+		go func() {
+			defer ts.wg.Done()
+			defer ts.untrack(conn)
+			handle(conn)
+		}()
+	}
+}
+
+// untrack stops tracking the connection, which is no longer closed by Close
+func (ts *tcpServer) untrack(conn net.Conn) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	delete(ts.conns, conn)
+}
+
+func (ts *tcpServer) Addr() net.Addr {
+	return ts.ln.Addr()
+}
+
+func (ts *tcpServer) Close() {
+	ts.ln.Close()
+	ts.lock.Lock()
+	for conn := range ts.conns {
+		conn.Close()
+	}
+	ts.lock.Unlock()
+	ts.wg.Wait()
+}
+
+// udpServer reads the packets with the read buffer of the socket
+type udpServer struct {
+	name string
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+}
+
+func listenUDP(name, addr string, readBuffer int, handle func([]byte, net.Addr)) (us *udpServer, err error) {
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	us = &udpServer{name: name}
+	us.conn, err = net.ListenUDP("udp", uaddr)
+	if err != nil {
+		return nil, err
+	}
+	if readBuffer > 0 {
+		if err = us.conn.SetReadBuffer(readBuffer); err != nil {
+			us.conn.Close()
+			return nil, err
+		}
+	}
+	us.wg.Add(1)
+	go us.serve(handle)
+	log.Printf("%s udp service start, listen on %s", name, us.conn.LocalAddr())
+	return
+}
+
+func (us *udpServer) serve(handle func([]byte, net.Addr)) {
+	defer us.wg.Done()
+	buf := make([]byte, MaxUDPPayload)
+	for {
+		n, addr, err := us.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("%s read error: %s", us.name, err)
+			continue
+		}
+		handle(buf[:n], addr)
+	}
+}
+
+func (us *udpServer) Addr() net.Addr {
+	return us.conn.LocalAddr()
+}
+
+func (us *udpServer) Close() {
+	us.conn.Close()
+	us.wg.Wait()
+}
+
+// readLines calls handle with each trimmed non-empty line until the reader is closed or a line exceeds maxLineSize,
+// and calls sync if not nil once the lines read at a time are handled
+func readLines(name string, conn net.Conn, r io.Reader, maxLineSize int, handle func(string), sync func()) {
+	sr := &syncReader{r: r, sync: sync}
+	scanner := bufio.NewScanner(sr)
+	size := bufio.MaxScanTokenSize
+	if maxLineSize < size {
+		size = maxLineSize
+	}
+	// the buffer holds the newline besides the line
+	scanner.Buffer(make([]byte, 0, size), maxLineSize+1)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			handle(line)
+			sr.pending = true
+		}
+	}
+	sr.flush()
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			log.Printf("%s read error: line exceeds max_line_size %d, connection closed, client: %s", name, maxLineSize, conn.RemoteAddr())
+		} else if !errors.Is(err, net.ErrClosed) {
+			log.Printf("%s read error: %s, client: %s", name, err, conn.RemoteAddr())
+		}
+	}
+}
+
+// syncReader calls sync before reading more data, so that the lines read at a time are synced once
+type syncReader struct {
+	r       io.Reader
+	sync    func()
+	pending bool
+}
+
+func (sr *syncReader) Read(p []byte) (int, error) {
+	sr.flush()
+	return sr.r.Read(p)
+}
+
+func (sr *syncReader) flush() {
+	if sr.pending && sr.sync != nil {
+		sr.sync()
+	}
+	sr.pending = false
+}
+
+// chanListener is a net.Listener that accepts the connections pushed to its channel
+type chanListener struct {
+	addr net.Addr
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{addr: addr, ch: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (ln *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.ch:
+		return conn, nil
+	case <-ln.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (ln *chanListener) Push(conn net.Conn) {
+	select {
+	case ln.ch <- conn:
+	case <-ln.done:
+		conn.Close()
+	}
+}
+
+func (ln *chanListener) Close() error {
+	ln.once.Do(func() { close(ln.done) })
+	return nil
+}
+
+func (ln *chanListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// bufferedConn is a net.Conn that reads the peeked bytes first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// OpenTSDBService accepts the telnet put commands and the http /api/put requests on the same port
+type OpenTSDBService struct {
+	ip       *backend.Proxy
+	bindAddr string
+	db       string
+	rp       string
+	ts       *tcpServer
+	httpLn   *chanListener
+	server   *http.Server
+}
+
+func NewOpenTSDBService(cfg *backend.OpenTSDBConfig, ip *backend.Proxy) *OpenTSDBService {
+	return &OpenTSDBService{
+		ip:       ip,
+		bindAddr: cfg.BindAddr,
+		db:       cfg.Database,
+		rp:       cfg.RetentionPolicy,
+	}
+}
+
+func (s *OpenTSDBService) Open() (err error) {
+	s.ts, err = listenTCP("opentsdb", s.bindAddr, s.handleConn)
+	if err != nil {
+		return
+	}
+	s.httpLn = newChanListener(s.ts.Addr())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/put", s.HandlerPut)
+	s.server = &http.Server{Handler: mux}
+	go func() {
+		if err := s.server.Serve(s.httpLn); err != http.ErrServerClosed {
+			log.Printf("opentsdb http service error: %s", err)
+		}
+	}()
+	return
+}
+
+// Close shuts down the http server before the telnet connections, in the same order as the proxy shuts down
+func (s *OpenTSDBService) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.ip.Config().ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Printf("opentsdb http service shutdown error: %s", err)
+	}
+	s.ts.Close()
+}
+
+// handleConn dispatches the connection to telnet or http by the first bytes
+func (s *OpenTSDBService) handleConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	peek, err := r.Peek(4)
+	if err == nil && string(peek) != "put " {
+		s.ts.untrack(conn)
+		s.httpLn.Push(&bufferedConn{Conn: conn, r: r})
+		return
+	}
+	defer conn.Close()
+	if err != nil {
+		return
+	}
+	readLines("opentsdb", conn, r, s.ip.Config().MaxLineSize, func(line string) {
+		pt, err := backend.ParseOpenTSDBPut(line)
+		if err == nil {
+			var p []byte
+			if p, err = pt.Line(); err == nil {
+				err = s.ip.WriteRow(p, s.db, s.rp, "ns")
+			}
+		}
+		if err != nil {
+			log.Printf("opentsdb telnet error: %s, line: %s, client: %s", err, line, conn.RemoteAddr())
+		}
+	}, s.ip.SyncWAL)
+}
+
+func (s *OpenTSDBService) HandlerPut(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	cfg := s.ip.Config()
+	if !checkRequestAuth(cfg, req) {
+		http.Error(w, "authentication failed", 401)
+		return
+	}
+	p, err := readBody(req, int64(cfg.MaxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+	pts, err := backend.ParseOpenTSDBJSON(p)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	err = s.ip.WriteOpenTSDB(pts, s.db, s.rp)
+	if err != nil {
+		log.Printf("opentsdb put error: %s, client: %s", err, req.RemoteAddr)
+		status := 400
+		if err == backend.ErrBackendOverloaded {
+			// the same response as /write, so that the client backs off in the same way
+			w.Header().Set("Retry-After", strconv.Itoa(cfg.RetryAfter))
+			status = cfg.OverflowStatus
+		} else if errors.Is(err, backend.ErrBufferFailed) {
+			status = 500
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/otlppb"
+)
+
+func (hs *HttpService) HandlerOTLPMetrics(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	cfg := hs.ip.Config()
+	db, rp := cfg.OTLP.Database, cfg.OTLP.RetentionPolicy
+	if !hs.checkDatabase(w, req, db) {
+		return
+	}
+	p, err := readBody(req, int64(cfg.MaxBodySize))
+	if err != nil {
+		hs.WriteError(w, req, bodyErrorStatus(err), err.Error())
+		return
+	}
+	isJSON := strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+	var mr otlppb.ExportMetricsServiceRequest
+	if isJSON {
+		err = json.Unmarshal(p, &mr)
+	} else {
+		err = mr.Unmarshal(p)
+	}
+	if err != nil {
+		hs.WriteError(w, req, 400, err.Error())
+		return
+	}
+
+	err = hs.ip.WriteOTLP(&mr, db, rp)
+	var resp otlppb.ExportMetricsServiceResponse
+	switch e := err.(type) {
+	case nil:
+	case *backend.PartialWriteError:
+		// the rejected data points are reported in the partial success, and the client shouldn't retry
+		log.Printf("otlp write error: %s, db: %s, rp: %s, client: %s", err, db, rp, req.RemoteAddr)
+		resp.PartialSuccess = &otlppb.ExportMetricsPartialSuccess{RejectedDataPoints: int64(e.Dropped), ErrorMessage: e.Error()}
+	default:
+		log.Printf("otlp write error: %s, db: %s, rp: %s, client: %s", err, db, rp, req.RemoteAddr)
+		hs.WriteResult(w, req, err)
+		return
+	}
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := json.Marshal(&resp)
+		hs.WriteBody(w, body)
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		hs.WriteBody(w, resp.Marshal(nil))
+	}
+	if cfg.WriteTracing {
+		log.Printf("otlp write: %s %s %d resource metrics, client: %s", db, rp, len(mr.ResourceMetrics), req.RemoteAddr)
+	}
+}
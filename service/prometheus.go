@@ -0,0 +1,104 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/prompb"
+	"github.com/golang/snappy"
+)
+
+// readSnappyBody reads the snappy body, both the compressed and the decoded size are limited by the max body size
+func readSnappyBody(req *http.Request, maxBodySize int) ([]byte, error) {
+	compressed, err := ioutil.ReadAll(limitBody(req.Body, int64(maxBodySize)))
+	if err != nil {
+		return nil, err
+	}
+	p, err := backend.DecodeSnappy(compressed, maxBodySize)
+	if err == backend.ErrDecodedTooLarge {
+		return nil, ErrBodyTooLarge
+	}
+	if err != nil {
+		return nil, errors.New("unable to decode snappy body")
+	}
+	return p, nil
+}
+
+func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	db := req.URL.Query().Get("db")
+	if !hs.checkDatabase(w, req, db) {
+		return
+	}
+	rp := req.URL.Query().Get("rp")
+
+	cfg := hs.ip.Config()
+	p, err := readSnappyBody(req, cfg.MaxBodySize)
+	if err != nil {
+		hs.WriteError(w, req, bodyErrorStatus(err), err.Error())
+		return
+	}
+	var wr prompb.WriteRequest
+	if err = wr.Unmarshal(p); err != nil {
+		hs.WriteError(w, req, 400, err.Error())
+		return
+	}
+
+	err = hs.ip.WritePrometheus(&wr, db, rp, cfg.PromMeasurement)
+	if err != nil {
+		log.Printf("prometheus write error: %s, db: %s, rp: %s, client: %s", err, db, rp, req.RemoteAddr)
+	}
+	hs.WriteResult(w, req, err)
+	if cfg.WriteTracing {
+		log.Printf("prometheus write: %s %s %d timeseries, client: %s", db, rp, len(wr.Timeseries), req.RemoteAddr)
+	}
+}
+
+func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	db := req.URL.Query().Get("db")
+	if !hs.checkDatabase(w, req, db) {
+		return
+	}
+	rp := req.URL.Query().Get("rp")
+
+	cfg := hs.ip.Config()
+	p, err := readSnappyBody(req, cfg.MaxBodySize)
+	if err != nil {
+		hs.WriteError(w, req, bodyErrorStatus(err), err.Error())
+		return
+	}
+	var rr prompb.ReadRequest
+	if err = rr.Unmarshal(p); err != nil {
+		hs.WriteError(w, req, 400, err.Error())
+		return
+	}
+
+	resp, err := hs.ip.ReadPrometheus(&rr, db, rp, cfg.PromMeasurement)
+	if err != nil {
+		log.Printf("prometheus read error: %s, db: %s, rp: %s, client: %s", err, db, rp, req.RemoteAddr)
+		hs.WriteError(w, req, 400, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	hs.WriteBody(w, snappy.Encode(nil, resp.Marshal(nil)))
+	if cfg.QueryTracing {
+		log.Printf("prometheus read: %s %s %d queries, client: %s", db, rp, len(rr.Queries), req.RemoteAddr)
+	}
+}
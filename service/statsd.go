@@ -0,0 +1,118 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// StatsdService accepts the statsd lines on tcp or udp, and writes the aggregated points every flush interval
+type StatsdService struct {
+	ip         *backend.Proxy
+	agg        *backend.StatsdAggregator
+	bindAddr   string
+	protocol   string
+	db         string
+	rp         string
+	interval   time.Duration
+	readBuffer int
+	ts         *tcpServer
+	us         *udpServer
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+func NewStatsdService(cfg *backend.StatsdConfig, ip *backend.Proxy) *StatsdService {
+	return &StatsdService{
+		ip:         ip,
+		agg:        backend.NewStatsdAggregator(cfg.Percentiles),
+		bindAddr:   cfg.BindAddr,
+		protocol:   cfg.Protocol,
+		db:         cfg.Database,
+		rp:         cfg.RetentionPolicy,
+		interval:   time.Duration(cfg.FlushInterval) * time.Second,
+		readBuffer: cfg.ReadBuffer,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+func (s *StatsdService) Open() (err error) {
+	if s.protocol == "udp" {
+		s.us, err = listenUDP("statsd", s.bindAddr, s.readBuffer, s.handlePacket)
+	} else {
+		s.ts, err = listenTCP("statsd", s.bindAddr, s.handleConn)
+	}
+	if err != nil {
+		return
+	}
+	go s.flushLoop()
+	return
+}
+
+// Close stops the listener and flushes the remaining metrics
+func (s *StatsdService) Close() {
+	if s.ts != nil {
+		s.ts.Close()
+	}
+	if s.us != nil {
+		s.us.Close()
+	}
+	close(s.done)
+	<-s.stopped
+}
+
+func (s *StatsdService) flushLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *StatsdService) flush() {
+	for _, line := range s.agg.Flush(time.Now()) {
+		if err := s.ip.WriteRow(line, s.db, s.rp, "ns"); err != nil {
+			log.Printf("statsd write error: %s, line: %s", err, line)
+		}
+	}
+	s.ip.SyncWAL()
+}
+
+func (s *StatsdService) handleConn(conn net.Conn) {
+	defer conn.Close()
+	readLines("statsd", conn, conn, s.ip.Config().MaxLineSize, func(line string) {
+		s.handleLine(line, conn.RemoteAddr())
+	}, nil)
+}
+
+func (s *StatsdService) handlePacket(buf []byte, addr net.Addr) {
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			s.handleLine(string(line), addr)
+		}
+	}
+}
+
+func (s *StatsdService) handleLine(line string, addr net.Addr) {
+	m, err := backend.ParseStatsd(line)
+	if err != nil {
+		log.Printf("statsd parse error: %s, line: %s, client: %s", err, line, addr)
+		return
+	}
+	s.agg.Add(m)
+}
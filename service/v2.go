@@ -0,0 +1,161 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func (hs *HttpService) HandlerV2Write(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "POST" {
+		hs.WriteV2Error(w, 405, "method not allow")
+		return
+	}
+	cfg := hs.ip.Config()
+	if !checkRequestToken(cfg, req) {
+		hs.WriteV2Error(w, 401, "authentication failed")
+		return
+	}
+
+	precision := req.URL.Query().Get("precision")
+	switch precision {
+	case "", "ns":
+		precision = "ns"
+	case "us":
+		precision = "u"
+	case "ms", "s":
+		// it's valid
+	default:
+		hs.WriteV2Error(w, 400, fmt.Sprintf("invalid precision %q (use ns, us, ms or s)", precision))
+		return
+	}
+
+	bucket := req.URL.Query().Get("bucket")
+	if bucket == "" {
+		hs.WriteV2Error(w, 400, "bucket not found")
+		return
+	}
+	db, rp := hs.ip.GetDatabaseFromBucket(bucket)
+	if !hs.ip.AllowDatabase(db) {
+		hs.WriteV2Error(w, 400, fmt.Sprintf("database forbidden: %s", db))
+		return
+	}
+
+	body, err := bodyReader(req, int64(cfg.MaxBodySize))
+	if err != nil {
+		hs.WriteV2Error(w, 400, err.Error())
+		return
+	}
+	defer body.Close()
+	var r io.Reader = body
+	var trace bytes.Buffer
+	if cfg.WriteTracing {
+		r = io.TeeReader(body, &trace)
+	}
+
+	// the lines are written as they are read, and the reading error aborts the rest of the body
+	err = hs.ip.WriteReader(r, db, rp, precision, nil)
+	if err != nil {
+		log.Printf("v2 write error: %s, bucket: %s, precision: %s, client: %s", err, bucket, precision, req.RemoteAddr)
+	}
+	switch err.(type) {
+	case nil:
+		hs.WriteHeader(w, 204)
+	case *backend.PartialWriteError:
+		hs.WriteV2Error(w, 400, err.Error())
+	default:
+		if err == backend.ErrBackendOverloaded || errors.Is(err, backend.ErrBufferFailed) {
+			hs.WriteV2Error(w, hs.writeErrorStatus(w, err), err.Error())
+		} else {
+			hs.WriteV2Error(w, bodyErrorStatus(err), err.Error())
+		}
+	}
+	if cfg.WriteTracing {
+		log.Printf("v2 write: %s %s %s %s, client: %s", db, rp, precision, trace.Bytes(), req.RemoteAddr)
+	}
+}
+
+func (hs *HttpService) HandlerV2Query(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethod(w, req, "POST") || !hs.checkTokenAuth(w, req) {
+		return
+	}
+
+	cfg := hs.ip.Config()
+	p, err := readBody(req, int64(cfg.MaxBodySize))
+	if err != nil {
+		hs.WriteError(w, req, bodyErrorStatus(err), err.Error())
+		return
+	}
+	body, err := backend.QueryFlux(w, req, hs.ip, p)
+	if err != nil {
+		log.Printf("flux query error: %s, query: %s, client: %s", err, p, req.RemoteAddr)
+		hs.WriteError(w, req, 400, err.Error())
+		return
+	}
+	hs.WriteBody(w, body)
+	if cfg.QueryTracing {
+		log.Printf("flux query: %s, client: %s", p, req.RemoteAddr)
+	}
+}
+
+// checkTokenAuth checks the token in the form of `Token username:password` used by InfluxDB 2.x clients,
+// and falls back to the auth of InfluxDB 1.x if the token is absent
+func (hs *HttpService) checkTokenAuth(w http.ResponseWriter, req *http.Request) bool {
+	if checkRequestToken(hs.ip.Config(), req) {
+		return true
+	}
+	hs.WriteError(w, req, 401, "authentication failed")
+	return false
+}
+
+// checkRequestToken reports whether the request carries the auth of the config by the token or the auth of InfluxDB 1.x
+func checkRequestToken(cfg *backend.ProxyConfig, req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Token ") {
+		return checkRequestAuth(cfg, req)
+	}
+	if cfg.Username == "" && cfg.Password == "" {
+		return true
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Token "))
+	if i := strings.IndexByte(token, ':'); i >= 0 {
+		return matchAuth(cfg, token[:i], token[i+1:])
+	}
+	return false
+}
+
+// v2ErrorCodes maps the status to the error code of InfluxDB 2.x
+var v2ErrorCodes = map[int]string{
+	400: "invalid",
+	401: "unauthorized",
+	404: "not found",
+	405: "method not allowed",
+	413: "request too large",
+	429: "too many requests",
+	503: "unavailable",
+}
+
+// WriteV2Error writes the error in the form of `{"code", "message"}` used by InfluxDB 2.x
+func (hs *HttpService) WriteV2Error(w http.ResponseWriter, status int, msg string) {
+	code, ok := v2ErrorCodes[status]
+	if !ok {
+		code = "internal error"
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Influxdb-Error", msg)
+	hs.WriteHeader(w, status)
+	w.Write(util.MarshalJSON(map[string]string{"code": code, "message": msg}, false))
+}
@@ -17,6 +17,7 @@ type Stats struct {
 	MeasurementDone  int32 `json:"measurement_done"`
 	TransferCount    int32 `json:"transfer_count"`
 	InPlaceCount     int32 `json:"inplace_count"`
+	ShardedCount     int32 `json:"sharded_count"`
 }
 
 type CircleState struct {
@@ -46,5 +47,6 @@ func (cs *CircleState) ResetStates() {
 		s.MeasurementDone = 0
 		s.TransferCount = 0
 		s.InPlaceCount = 0
+		s.ShardedCount = 0
 	}
 }
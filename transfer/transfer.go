@@ -38,6 +38,9 @@ type QueryResult struct {
 	Err    error
 }
 
+// router picks the backends among the destinations to which the line of a sharded measurement is written
+type router func(line []byte) []*backend.Backend
+
 type Transfer struct {
 	username     string
 	password     string
@@ -165,8 +168,11 @@ func reformFieldKeys(fieldKeys map[string][]string) map[string]string {
 	return fieldMap
 }
 
-func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, meas string, tagMap util.Set, fieldMap map[string]string) error {
-	var buf bytes.Buffer
+func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, rt router, db, meas string, tagMap util.Set, fieldMap map[string]string) error {
+	bufs := make(map[*backend.Backend]*bytes.Buffer, len(dsts))
+	for _, dst := range dsts {
+		bufs[dst] = &bytes.Buffer{}
+	}
 	var wg sync.WaitGroup
 	pool, err := ants.NewPool(len(dsts) * 20)
 	if err != nil {
@@ -205,11 +211,21 @@ func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, mea
 			mtagStr := strings.Join(mtagSet, ",")
 			fieldStr := strings.Join(fieldSet, ",")
 			line := fmt.Sprintf("%s %s %v\n", mtagStr, fieldStr, value[0])
-			buf.WriteString(line)
+			targets := dsts
+			if rt != nil {
+				targets = rt([]byte(line))
+			}
+			for _, dst := range targets {
+				bufs[dst].WriteString(line)
+			}
 			if (idx+1)%tx.Batch == 0 || idx+1 == valen {
-				p := buf.Bytes()
 				for _, dst := range dsts {
 					dst := dst
+					if bufs[dst].Len() == 0 {
+						continue
+					}
+					p := bufs[dst].Bytes()
+					bufs[dst] = &bytes.Buffer{}
 					wg.Add(1)
 					pool.Submit(func() {
 						defer wg.Done()
@@ -219,7 +235,7 @@ func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, mea
 								time.Sleep(time.Duration(RetryInterval) * time.Second)
 								tlog.Printf("transfer write retry: %d, last err:%s dst:%s db:%s meas:%s", i, err, dst.Url, db, meas)
 							}
-							err = dst.Write(db, "", p)
+							err = dst.Write(db, "", "ns", p)
 							if err == nil {
 								break
 							}
@@ -229,7 +245,6 @@ func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, mea
 						}
 					})
 				}
-				buf = bytes.Buffer{}
 			}
 		}
 	}
@@ -273,7 +288,7 @@ func (tx *Transfer) query(ch chan *QueryResult, src *backend.Backend, db, meas s
 	}
 }
 
-func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, db, meas string, tick int64) error {
+func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, rt router, db, meas string, tick int64) error {
 	ch := make(chan *QueryResult, 4)
 	go tx.query(ch, src, db, meas, tick)
 
@@ -293,14 +308,14 @@ func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, db,
 		fieldMap = reformFieldKeys(fieldKeys)
 	}()
 	wg.Wait()
-	return tx.write(ch, dsts, db, meas, tagMap, fieldMap)
+	return tx.write(ch, dsts, rt, db, meas, tagMap, fieldMap)
 }
 
-func (tx *Transfer) submitTransfer(cs *CircleState, src *backend.Backend, dsts []*backend.Backend, db, meas string, tick int64) {
+func (tx *Transfer) submitTransfer(cs *CircleState, src *backend.Backend, dsts []*backend.Backend, rt router, db, meas string, tick int64) {
 	cs.wg.Add(1)
 	tx.pool.Submit(func() {
 		defer cs.wg.Done()
-		err := tx.transfer(src, dsts, db, meas, tick)
+		err := tx.transfer(src, dsts, rt, db, meas, tick)
 		if err == nil {
 			tlog.Printf("transfer done, src:%s dst:%v db:%s meas:%s tick:%d", src.Url, getBackendUrls(dsts), db, meas, tick)
 		} else {
@@ -322,6 +337,38 @@ func (tx *Transfer) submitCleanup(cs *CircleState, be *backend.Backend, db, meas
 	})
 }
 
+// submitShardCleanup drops the series of the sharded measurement which belong to the other backends
+func (tx *Transfer) submitShardCleanup(cs *CircleState, be *backend.Backend, db, meas string, tags []string) {
+	cs.wg.Add(1)
+	tx.pool.Submit(func() {
+		defer cs.wg.Done()
+		key := backend.GetKey(db, meas)
+		checked := util.NewSet()
+		for _, series := range be.GetSeries(db, meas) {
+			line := []byte(series)
+			shardKey := backend.GetShardKey(key, line, tags)
+			if checked[shardKey] {
+				continue
+			}
+			checked.Add(shardKey)
+			if cs.GetBackend(shardKey).Url == be.Url {
+				continue
+			}
+			conds := make([]string, len(tags))
+			for i, tag := range tags {
+				value := util.UnescapeTag(string(backend.ScanTagValue(line, tag)))
+				conds[i] = fmt.Sprintf("\"%s\"='%s'", util.EscapeIdentifier(tag), util.EscapeStringLiteral(value))
+			}
+			_, err := be.DropSeries(db, meas, strings.Join(conds, " and "))
+			if err == nil {
+				tlog.Printf("cleanup done, backend:%s db:%s meas:%s shard:%s", be.Url, db, meas, shardKey)
+			} else {
+				tlog.Printf("cleanup error: %s, backend:%s db:%s meas:%s shard:%s", err, be.Url, db, meas, shardKey)
+			}
+		}
+	})
+}
+
 func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []string, fn func(*CircleState, *backend.Backend, string, string, []interface{}) bool, args ...interface{}) {
 	defer cs.wg.Done()
 	if !be.IsActive() {
@@ -348,7 +395,10 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 	for i, db := range dbs {
 		for _, meas := range measures[i] {
 			require := fn(cs, be, db, meas, args)
-			if require {
+			if cs.ShardRules.IsSharded(db, meas) {
+				// sharded measurement is spread over all backends by tags
+				atomic.AddInt32(&stats.ShardedCount, 1)
+			} else if require {
 				atomic.AddInt32(&stats.TransferCount, 1)
 			} else {
 				atomic.AddInt32(&stats.InPlaceCount, 1)
@@ -388,10 +438,28 @@ func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []s
 
 func (tx *Transfer) runRebalance(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
 	key := backend.GetKey(db, meas)
+	if tags := cs.ShardRules.Tags(db, meas); len(tags) > 0 {
+		dsts := make([]*backend.Backend, 0, len(cs.Backends))
+		for _, dst := range cs.Backends {
+			if dst.Url != be.Url {
+				dsts = append(dsts, dst)
+			}
+		}
+		require = len(dsts) > 0
+		if require {
+			tx.submitTransfer(cs, be, dsts, func(line []byte) []*backend.Backend {
+				if dst := cs.GetBackend(backend.GetShardKey(key, line, tags)); dst.Url != be.Url {
+					return []*backend.Backend{dst}
+				}
+				return nil
+			}, db, meas, 0)
+		}
+		return
+	}
 	dst := cs.GetBackend(key)
 	require = dst.Url != be.Url
 	if require {
-		tx.submitTransfer(cs, be, []*backend.Backend{dst}, db, meas, 0)
+		tx.submitTransfer(cs, be, []*backend.Backend{dst}, nil, db, meas, 0)
 	}
 	return
 }
@@ -438,10 +506,28 @@ func (tx *Transfer) runRecovery(fcs *CircleState, be *backend.Backend, db string
 	tcs := args[0].(*CircleState)
 	backendUrlSet := args[1].(util.Set) // nolint:golint
 	key := backend.GetKey(db, meas)
+	if tags := fcs.ShardRules.Tags(db, meas); len(tags) > 0 {
+		dsts := make([]*backend.Backend, 0, len(tcs.Backends))
+		for _, dst := range tcs.Backends {
+			if backendUrlSet[dst.Url] {
+				dsts = append(dsts, dst)
+			}
+		}
+		require = len(dsts) > 0
+		if require {
+			tx.submitTransfer(fcs, be, dsts, func(line []byte) []*backend.Backend {
+				if dst := tcs.GetBackend(backend.GetShardKey(key, line, tags)); backendUrlSet[dst.Url] {
+					return []*backend.Backend{dst}
+				}
+				return nil
+			}, db, meas, 0)
+		}
+		return
+	}
 	dst := tcs.GetBackend(key)
 	require = backendUrlSet[dst.Url]
 	if require {
-		tx.submitTransfer(fcs, be, []*backend.Backend{dst}, db, meas, 0)
+		tx.submitTransfer(fcs, be, []*backend.Backend{dst}, nil, db, meas, 0)
 	}
 	return
 }
@@ -479,6 +565,28 @@ func (tx *Transfer) Resync(dbs []string, tick int64) {
 func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
 	tick := args[0].(int64)
 	key := backend.GetKey(db, meas)
+	if tags := cs.ShardRules.Tags(db, meas); len(tags) > 0 {
+		dsts := make([]*backend.Backend, 0)
+		tcss := make([]*CircleState, 0)
+		for _, tcs := range tx.CircleStates {
+			if tcs.CircleId != cs.CircleId {
+				dsts = append(dsts, tcs.Backends...)
+				tcss = append(tcss, tcs)
+			}
+		}
+		require = len(tcss) > 0
+		if require {
+			tx.submitTransfer(cs, be, dsts, func(line []byte) []*backend.Backend {
+				shardKey := backend.GetShardKey(key, line, tags)
+				targets := make([]*backend.Backend, len(tcss))
+				for i, tcs := range tcss {
+					targets[i] = tcs.GetBackend(shardKey)
+				}
+				return targets
+			}, db, meas, tick)
+		}
+		return
+	}
 	dsts := make([]*backend.Backend, 0)
 	for _, tcs := range tx.CircleStates {
 		if tcs.CircleId != cs.CircleId {
@@ -488,7 +596,7 @@ func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, m
 	}
 	require = len(dsts) > 0
 	if require {
-		tx.submitTransfer(cs, be, dsts, db, meas, tick)
+		tx.submitTransfer(cs, be, dsts, nil, db, meas, tick)
 	}
 	return
 }
@@ -521,6 +629,11 @@ func (tx *Transfer) Cleanup(circleId int) { // nolint:golint
 }
 
 func (tx *Transfer) runCleanup(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
+	if tags := cs.ShardRules.Tags(db, meas); len(tags) > 0 {
+		tlog.Printf("backend:%s db:%s meas:%s require to check sharded series", be.Url, db, meas)
+		tx.submitShardCleanup(cs, be, db, meas, tags)
+		return true
+	}
 	key := backend.GetKey(db, meas)
 	dst := cs.GetBackend(key)
 	require = dst.Url != be.Url
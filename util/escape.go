@@ -13,6 +13,8 @@ var (
 	measurementUnescaper = strings.NewReplacer(`\,`, `,`, `\ `, ` `)
 	tagEscaper           = strings.NewReplacer(`,`, `\,`, ` `, `\ `, `=`, `\=`)
 	tagUnescaper         = strings.NewReplacer(`\,`, `,`, `\ `, ` `, `\=`, `=`)
+	stringFieldEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	stringLitEscaper     = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
 )
 
 func EscapeIdentifier(in string) string {
@@ -47,3 +49,11 @@ func UnescapeTag(in string) string {
 	}
 	return tagUnescaper.Replace(in)
 }
+
+func EscapeStringField(in string) string {
+	return stringFieldEscaper.Replace(in)
+}
+
+func EscapeStringLiteral(in string) string {
+	return stringLitEscaper.Replace(in)
+}